@@ -1,23 +1,23 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func publishGameLog(ch *amqp.Channel, username, message string) pubsub.AckType {
+func publishGameLog(ctx context.Context, pub pubsub.Publisher, username, message, correlationID string) pubsub.AckType {
 	gameLog := routing.GameLog{
 		CurrentTime: time.Now(),
 		Message:     message,
 		Username:    username,
 	}
 	routingKey := fmt.Sprintf("%s.%s", routing.GameLogSlug, username)
-	err := pubsub.PublishGob(ch, routing.ExchangePerilTopic, routingKey, gameLog)
+	err := pubsub.PublishGob(ctx, pub, routing.ExchangePerilTopic, routingKey, gameLog, pubsub.WithConfirm(), pubsub.WithCorrelationID(correlationID), compression)
 	if err != nil {
 		return pubsub.NackRequeue
 	}
@@ -26,16 +26,21 @@ func publishGameLog(ch *amqp.Channel, username, message string) pubsub.AckType {
 
 func handlerPause(gs *gamelogic.GameState) func(routing.PlayingState) pubsub.AckType {
 	return func(ps routing.PlayingState) pubsub.AckType {
-		defer fmt.Print("> ")
 		gs.HandlePause(ps)
 		return pubsub.Ack
 	}
 }
 
-func handlerMove(gs *gamelogic.GameState, ch *amqp.Channel) func(gamelogic.ArmyMove) pubsub.AckType {
-	return func(move gamelogic.ArmyMove) pubsub.AckType {
-		defer fmt.Print("> ")
+// handlerMove declares war on moves into the player's units. Wars are
+// encrypted with the key warKeyID returns for the attacker and defender.
+func handlerMove(gs *gamelogic.GameState, pub pubsub.Publisher, warKeyID func(ctx context.Context, attacker, defender string) (string, error)) func(pubsub.Message[gamelogic.ArmyMove]) pubsub.AckType {
+	return func(msg pubsub.Message[gamelogic.ArmyMove]) pubsub.AckType {
+		move := msg.Body
+		if signer := pubsub.Signer(msg.Delivery); signer != move.Player.Username {
+			return pubsub.Reject(msg.Context(), fmt.Sprintf("move signed by %q, not the mover %q", signer, move.Player.Username))
+		}
 		outcome := gs.HandleMove(move)
+		movesHandled.Inc(outcome.String())
 		if outcome == gamelogic.MoveOutComeSafe {
 			return pubsub.Ack
 		}
@@ -45,8 +50,13 @@ func handlerMove(gs *gamelogic.GameState, ch *amqp.Channel) func(gamelogic.ArmyM
 				Attacker: move.Player,
 				Defender: defender,
 			}
+			keyID, err := warKeyID(msg.Context(), move.Player.Username, defender.Username)
+			if err != nil {
+				pubsub.Logger(msg.Context()).Warn("could not get war key, requeueing", "error", err)
+				return pubsub.NackRequeue
+			}
 			routingKey := fmt.Sprintf("%s.%s", routing.WarRecognitionsPrefix, defender.Username)
-			err := pubsub.PublishJSON(ch, routing.ExchangePerilTopic, routingKey, warMsg)
+			err = pubsub.PublishJSON(msg.Context(), pub, routing.ExchangePerilTopic, routingKey, warMsg, pubsub.WithConfirm(), pubsub.WithCorrelationID(msg.Correlation()), compression, pubsub.WithEncryption(keyID))
 			if err != nil {
 				return pubsub.NackRequeue
 			}
@@ -57,10 +67,15 @@ func handlerMove(gs *gamelogic.GameState, ch *amqp.Channel) func(gamelogic.ArmyM
 	}
 }
 
-func handlerWar(gs *gamelogic.GameState, ch *amqp.Channel) func(gamelogic.RecognitionOfWar) pubsub.AckType {
-	return func(rw gamelogic.RecognitionOfWar) pubsub.AckType {
-		defer fmt.Print("> ")
+func handlerWar(gs *gamelogic.GameState, pub pubsub.Publisher) func(pubsub.Message[gamelogic.RecognitionOfWar]) pubsub.AckType {
+	return func(msg pubsub.Message[gamelogic.RecognitionOfWar]) pubsub.AckType {
+		rw := msg.Body
+		// Wars are declared by the defender's client when the move arrives.
+		if signer := pubsub.Signer(msg.Delivery); signer != rw.Defender.Username {
+			return pubsub.Reject(msg.Context(), fmt.Sprintf("war signed by %q, not the defender %q", signer, rw.Defender.Username))
+		}
 		outcome, winner, loser := gs.HandleWar(rw)
+		warsHandled.Inc(outcome.String())
 		switch outcome {
 		case gamelogic.WarOutcomeNotInvolved:
 			return pubsub.NackRequeue
@@ -68,15 +83,15 @@ func handlerWar(gs *gamelogic.GameState, ch *amqp.Channel) func(gamelogic.Recogn
 			return pubsub.NackDiscard
 		case gamelogic.WarOutcomeOpponentWon:
 			logMsg := fmt.Sprintf("%s won a war against %s", winner, loser)
-			return publishGameLog(ch, rw.Attacker.Username, logMsg)
+			return publishGameLog(msg.Context(), pub, rw.Attacker.Username, logMsg, msg.Correlation())
 		case gamelogic.WarOutcomeYouWon:
 			logMsg := fmt.Sprintf("%s won a war against %s", winner, loser)
-			return publishGameLog(ch, rw.Attacker.Username, logMsg)
+			return publishGameLog(msg.Context(), pub, rw.Attacker.Username, logMsg, msg.Correlation())
 		case gamelogic.WarOutcomeDraw:
 			logMsg := fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser)
-			return publishGameLog(ch, rw.Attacker.Username, logMsg)
+			return publishGameLog(msg.Context(), pub, rw.Attacker.Username, logMsg, msg.Correlation())
 		default:
-			fmt.Printf("Error: unknown war outcome: %v\n", outcome)
+			pubsub.Logger(msg.Context()).Error("unknown war outcome", "outcome", outcome.String())
 			return pubsub.NackDiscard
 		}
 	}
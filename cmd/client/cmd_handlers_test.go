@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func newTestBroker(t *testing.T) *pubsub.MemoryBroker {
+	t.Helper()
+	b := pubsub.NewMemoryBroker()
+	err := pubsub.ApplyTopology(context.Background(), b, routing.PerilTopology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// newPlayer returns the game state of a player with the given units, each
+// a location and rank.
+func newPlayer(t *testing.T, username string, units ...[2]string) *gamelogic.GameState {
+	t.Helper()
+	gs := gamelogic.NewGameState(username)
+	for _, u := range units {
+		err := gs.CommandSpawn([]string{"spawn", u[0], u[1]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return gs
+}
+
+// settled reports how each delivery the subscription handles is settled,
+// dropping reports nobody is waiting for.
+func settled(results chan<- pubsub.AckType) pubsub.SubscribeOption {
+	return pubsub.WithMiddleware(func(next pubsub.DeliveryHandler) pubsub.DeliveryHandler {
+		return func(ctx context.Context, d pubsub.Delivery) pubsub.AckType {
+			ackType := next(ctx, d)
+			select {
+			case results <- ackType:
+			default:
+			}
+			return ackType
+		}
+	})
+}
+
+func waitForAck(t *testing.T, results <-chan pubsub.AckType) pubsub.AckType {
+	t.Helper()
+	select {
+	case ackType := <-results:
+		return ackType
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the delivery to be settled")
+	}
+	return 0
+}
+
+func consume(t *testing.T, b *pubsub.MemoryBroker, exchange, queueName, key string) <-chan pubsub.Delivery {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	deliveries, err := b.Consume(ctx, exchange, queueName, key, pubsub.Durable, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+func consumeDeadLetters(t *testing.T, b *pubsub.MemoryBroker) <-chan pubsub.Delivery {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	deliveries, err := b.ConsumeQueue(ctx, pubsub.QueueSpec{Name: routing.DeadLetterQueue, Durable: true}, routing.ExchangePerilDLX, "#", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+func receive(t *testing.T, deliveries <-chan pubsub.Delivery) pubsub.Delivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a delivery")
+	}
+	return pubsub.Delivery{}
+}
+
+func expectNone(t *testing.T, deliveries <-chan pubsub.Delivery) {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		t.Fatalf("unexpected delivery with routing key %q", d.RoutingKey)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func signedBy(b *pubsub.MemoryBroker, username string) pubsub.Publisher {
+	return pubsub.NewSigningPublisher(b, username, pubsub.NewSigningKey())
+}
+
+func TestHandlerPause(t *testing.T) {
+	b := newTestBroker(t)
+	gs := newPlayer(t, "alice", [2]string{"europe", "infantry"})
+	results := make(chan pubsub.AckType, 1)
+	sub, err := pubsub.SubscribeJSON(context.Background(), b, routing.ExchangePerilTopic, "pause.alice", routing.PauseKey, pubsub.Transient, handlerPause(gs), settled(results))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	for _, paused := range []bool{true, false} {
+		err := pubsub.PublishJSON(context.Background(), b, routing.ExchangePerilTopic, routing.PauseKey, routing.PlayingState{IsPaused: paused})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ackType := waitForAck(t, results); ackType != pubsub.Ack {
+			t.Fatalf("paused %v: settled with %v, want Ack", paused, ackType)
+		}
+		_, err = gs.CommandMove([]string{"move", "asia", "1"})
+		if gotPaused := err != nil; gotPaused != paused {
+			t.Fatalf("paused %v: move returned %v", paused, err)
+		}
+	}
+}
+
+func TestHandlerMove(t *testing.T) {
+	keyID, err := pubsub.RegisterEncryptionKey(pubsub.NewEncryptionKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	warKeyID := func(_ context.Context, attacker, defender string) (string, error) {
+		if attacker != "bob" || defender != "alice" {
+			t.Errorf("asked for the key to a war between %q and %q", attacker, defender)
+		}
+		return keyID, nil
+	}
+
+	tests := []struct {
+		name    string
+		signer  string
+		mover   *gamelogic.GameState
+		to      string
+		want    pubsub.AckType
+		wantWar bool
+	}{
+		{
+			name:   "elsewhere",
+			signer: "bob",
+			mover:  newPlayer(t, "bob", [2]string{"asia", "cavalry"}),
+			to:     "asia",
+			want:   pubsub.Ack,
+		},
+		{
+			name:    "into the defender's units",
+			signer:  "bob",
+			mover:   newPlayer(t, "bob", [2]string{"asia", "cavalry"}),
+			to:      "europe",
+			want:    pubsub.Ack,
+			wantWar: true,
+		},
+		{
+			name:   "own move",
+			signer: "alice",
+			mover:  newPlayer(t, "alice", [2]string{"asia", "cavalry"}),
+			to:     "europe",
+			want:   pubsub.NackDiscard,
+		},
+		{
+			name:   "signed by another player",
+			signer: "mallory",
+			mover:  newPlayer(t, "bob", [2]string{"asia", "cavalry"}),
+			to:     "asia",
+			want:   pubsub.NackDiscard,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			wars := consume(t, b, routing.ExchangePerilTopic, routing.WarRecognitionsPrefix, routing.WarRecognitionsPrefix+".*")
+			deadLetters := consumeDeadLetters(t, b)
+
+			gs := newPlayer(t, "alice", [2]string{"europe", "infantry"})
+			results := make(chan pubsub.AckType, 1)
+			sub, err := pubsub.SubscribeMessage(context.Background(), b, routing.ExchangePerilTopic, "army_moves.alice", routing.ArmyMovesPrefix+".*", pubsub.Transient, handlerMove(gs, signedBy(b, "alice"), warKeyID), settled(results))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+
+			mv, err := tt.mover.CommandMove([]string{"move", tt.to, "1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = pubsub.PublishJSON(context.Background(), signedBy(b, tt.signer), routing.ExchangePerilTopic, "army_moves."+tt.mover.GetUsername(), mv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ackType := waitForAck(t, results); ackType != tt.want {
+				t.Fatalf("settled with %v, want %v", ackType, tt.want)
+			}
+
+			if tt.wantWar {
+				war := receive(t, wars)
+				if war.RoutingKey != "war.alice" || pubsub.Signer(war) != "alice" {
+					t.Fatalf("war published with routing key %q by %q", war.RoutingKey, pubsub.Signer(war))
+				}
+				if id := war.Headers[pubsub.EncryptionKeyHeader]; id != keyID {
+					t.Fatalf("war encrypted with key %v, want %v", id, keyID)
+				}
+			} else {
+				expectNone(t, wars)
+			}
+			if tt.want == pubsub.NackDiscard {
+				dl := receive(t, deadLetters)
+				if dl.RoutingKey != "army_moves."+tt.mover.GetUsername() {
+					t.Fatalf("dead letter has routing key %q", dl.RoutingKey)
+				}
+				if reason, _ := dl.Headers[pubsub.RejectionReasonHeader].(string); (tt.signer != tt.mover.GetUsername()) != (reason != "") {
+					t.Fatalf("dead letter has rejection reason %q", reason)
+				}
+			} else {
+				expectNone(t, deadLetters)
+			}
+		})
+	}
+}
+
+func TestHandlerWar(t *testing.T) {
+	tests := []struct {
+		name        string
+		signer      string
+		attacker    *gamelogic.GameState
+		defender    *gamelogic.GameState
+		want        pubsub.AckType
+		wantGameLog bool
+	}{
+		{
+			name:        "attacker won",
+			signer:      "bob",
+			attacker:    newPlayer(t, "alice", [2]string{"europe", "artillery"}),
+			defender:    newPlayer(t, "bob", [2]string{"europe", "infantry"}),
+			want:        pubsub.Ack,
+			wantGameLog: true,
+		},
+		{
+			name:        "defender won",
+			signer:      "bob",
+			attacker:    newPlayer(t, "alice", [2]string{"europe", "infantry"}),
+			defender:    newPlayer(t, "bob", [2]string{"europe", "artillery"}),
+			want:        pubsub.Ack,
+			wantGameLog: true,
+		},
+		{
+			name:        "draw",
+			signer:      "bob",
+			attacker:    newPlayer(t, "alice", [2]string{"europe", "cavalry"}),
+			defender:    newPlayer(t, "bob", [2]string{"europe", "cavalry"}),
+			want:        pubsub.Ack,
+			wantGameLog: true,
+		},
+		{
+			name:     "no units in the same place",
+			signer:   "bob",
+			attacker: newPlayer(t, "alice", [2]string{"asia", "cavalry"}),
+			defender: newPlayer(t, "bob", [2]string{"europe", "cavalry"}),
+			want:     pubsub.NackDiscard,
+		},
+		{
+			name:     "signed by another player",
+			signer:   "mallory",
+			attacker: newPlayer(t, "alice", [2]string{"europe", "artillery"}),
+			defender: newPlayer(t, "bob", [2]string{"europe", "infantry"}),
+			want:     pubsub.NackDiscard,
+		},
+		{
+			name:     "not involved",
+			signer:   "bob",
+			attacker: newPlayer(t, "carol", [2]string{"europe", "artillery"}),
+			defender: newPlayer(t, "bob", [2]string{"europe", "infantry"}),
+			want:     pubsub.NackRequeue,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			gameLogs := consume(t, b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*")
+			deadLetters := consumeDeadLetters(t, b)
+
+			// The handler is alice's, who attacked in every case but one.
+			gs := newPlayer(t, "alice", [2]string{"europe", "infantry"})
+			results := make(chan pubsub.AckType, 1)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			_, err := pubsub.SubscribeMessage(ctx, b, routing.ExchangePerilTopic, routing.WarRecognitionsPrefix, routing.WarRecognitionsPrefix+".*", pubsub.Durable, handlerWar(gs, signedBy(b, "alice")), settled(results))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rw := gamelogic.RecognitionOfWar{
+				Attacker: tt.attacker.GetPlayerSnap(),
+				Defender: tt.defender.GetPlayerSnap(),
+			}
+			err = pubsub.PublishJSON(context.Background(), signedBy(b, tt.signer), routing.ExchangePerilTopic, "war."+rw.Defender.Username, rw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ackType := waitForAck(t, results); ackType != tt.want {
+				t.Fatalf("settled with %v, want %v", ackType, tt.want)
+			}
+			// A requeued war comes straight back, so stop handling it.
+			cancel()
+
+			if tt.wantGameLog {
+				gameLog := receive(t, gameLogs)
+				if gameLog.RoutingKey != "game_logs.alice" || pubsub.Signer(gameLog) != "alice" {
+					t.Fatalf("game log published with routing key %q by %q", gameLog.RoutingKey, pubsub.Signer(gameLog))
+				}
+			} else {
+				expectNone(t, gameLogs)
+			}
+			if tt.want == pubsub.NackDiscard {
+				dl := receive(t, deadLetters)
+				if reason, _ := dl.Headers[pubsub.RejectionReasonHeader].(string); (tt.signer != rw.Defender.Username) != (reason != "") {
+					t.Fatalf("dead letter has rejection reason %q", reason)
+				}
+			} else {
+				expectNone(t, deadLetters)
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+var (
+	movesHandled = pubsub.NewCounter("peril_moves_handled_total",
+		"Moves by other players handled, by outcome.", "outcome")
+	warsHandled = pubsub.NewCounter("peril_wars_handled_total",
+		"War recognitions handled, by outcome.", "outcome")
+)
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+// openOutbox opens the player's outbox, which holds moves and game logs
+// published while RabbitMQ was down until they can be sent.
+func openOutbox(pub pubsub.Publisher, username string) (*pubsub.Outbox, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "peril", username+".outbox")
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return pubsub.NewOutbox(pub, path)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// signingKey returns the player's signing key. The server only issues a
+// username's key once, so it is cached on disk for the next session.
+func signingKey(ctx context.Context, rpc *pubsub.RPCClient, username string) ([]byte, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "peril", username+".key")
+
+	key, err := os.ReadFile(path)
+	if err == nil {
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read signing key: %w", err)
+	}
+
+	resp, err := pubsub.Request[routing.PlayerRequest, routing.SigningKey](ctx, rpc, routing.SigningKeyRPC, routing.PlayerRequest{Username: username})
+	if err != nil {
+		return nil, fmt.Errorf("could not get signing key: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		err = os.WriteFile(path, resp.Key, 0600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not save signing key: %w", err)
+	}
+	return resp.Key, nil
+}
+
+// awaitSigningKey fetches the player's signing key, retrying with backoff
+// until it succeeds or ctx is done, since the server may start after the
+// client. Once it is known rpc signs everything it publishes to pub, which
+// the server needs to hand out war keys.
+func awaitSigningKey(ctx context.Context, rpc *pubsub.RPCClient, pub pubsub.Publisher, username string, logger *slog.Logger) ([]byte, error) {
+	delay := time.Second
+	for {
+		key, err := signingKey(ctx, rpc, username)
+		if err == nil {
+			rpc.SetPublisher(pubsub.NewSigningPublisher(pub, username, key))
+			return key, nil
+		}
+
+		logger.Warn("could not get signing key from the server, retrying", "error", err, "retry_in", delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, 30*time.Second)
+	}
+}
+
+// warKeys fetches the keys for the player's wars from the server, which
+// only gives the key for a war to its attacker and defender. Keys are
+// registered for decryption and cached by opponent.
+type warKeys struct {
+	rpc      *pubsub.RPCClient
+	username string
+
+	mu  sync.Mutex
+	ids map[string]string
+}
+
+func newWarKeys(rpc *pubsub.RPCClient, username string) *warKeys {
+	return &warKeys{rpc: rpc, username: username, ids: map[string]string{}}
+}
+
+// keyID returns the ID of the key for wars between attacker and defender,
+// one of whom must be the player.
+func (w *warKeys) keyID(ctx context.Context, attacker, defender string) (string, error) {
+	opponent := attacker
+	if opponent == w.username {
+		opponent = defender
+	}
+	w.mu.Lock()
+	id, ok := w.ids[opponent]
+	w.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	resp, err := pubsub.Request[routing.WarKeyRequest, routing.WarKey](ctx, w.rpc, routing.WarKeyRPC, routing.WarKeyRequest{Attacker: attacker, Defender: defender})
+	if err != nil {
+		return "", fmt.Errorf("could not get war key: %w", err)
+	}
+	id, err = pubsub.RegisterEncryptionKey(resp.Key)
+	if err != nil {
+		return "", err
+	}
+	w.mu.Lock()
+	w.ids[opponent] = id
+	w.mu.Unlock()
+	return id, nil
+}
+
+// fetch gets the key for a war before it is decoded. Wars are routed by
+// defender and handled by their attacker, so the player asks for the key
+// to wars against the defender. Wars the player isn't part of are
+// encrypted with another key, and are requeued for their attacker.
+func (w *warKeys) fetch(next pubsub.DeliveryHandler) pubsub.DeliveryHandler {
+	return func(ctx context.Context, d pubsub.Delivery) pubsub.AckType {
+		defender := strings.TrimPrefix(d.RoutingKey, routing.WarRecognitionsPrefix+".")
+		if defender != w.username {
+			_, err := w.keyID(ctx, w.username, defender)
+			if err != nil {
+				pubsub.Logger(ctx).Warn("could not get war key, requeueing", "defender", defender, "error", err)
+				return pubsub.NackRequeue
+			}
+		}
+		return next(ctx, d)
+	}
+}
+
+// serverVerifier asks the server to check signatures. Signing keys are
+// shared secrets, so only the server holds other players' keys.
+type serverVerifier struct {
+	rpc *pubsub.RPCClient
+}
+
+func (v serverVerifier) VerifySignature(ctx context.Context, signer string, content []byte, signature string) error {
+	result, err := pubsub.Request[routing.SignatureCheck, routing.SignatureResult](ctx, v.rpc, routing.VerifySignatureRPC, routing.SignatureCheck{
+		Signer:    signer,
+		Content:   content,
+		Signature: signature,
+	})
+	if err != nil {
+		return err
+	}
+	if !result.Valid {
+		return fmt.Errorf("%w: %s", pubsub.ErrBadSignature, result.Reason)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+const (
+	dlqDefaultFetch = 20
+	dlqIdleWait     = 500 * time.Millisecond
+)
+
+// dlqCommand inspects peril_dlq. Listed messages are held until they are
+// replayed, purged or released, so indexes stay stable between commands.
+type dlqCommand struct {
+	broker pubsub.Broker
+	mu     sync.Mutex
+	batch  *pubsub.DeadLetterBatch
+}
+
+func (c *dlqCommand) run(ctx context.Context, words []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(words) < 2 {
+		fmt.Println("Usage: dlq list [n] | dlq replay <i>...|all | dlq purge <i>...|all | dlq release")
+		return
+	}
+
+	switch words[1] {
+	case "list":
+		c.list(ctx, words[2:])
+	case "replay":
+		c.settle(words[2:], func(i int) error {
+			return c.batch.Replay(ctx, c.broker, i)
+		}, "Replayed")
+	case "purge":
+		c.settle(words[2:], c.batch.Purge, "Purged")
+	case "release":
+		c.release()
+		fmt.Println("Released dead letters back to the queue")
+	default:
+		fmt.Printf("Unknown dlq command: %s\n", words[1])
+	}
+}
+
+func (c *dlqCommand) list(ctx context.Context, args []string) {
+	n := dlqDefaultFetch
+	if len(args) > 0 {
+		var err error
+		n, err = strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			fmt.Printf("error: %s is not a valid count\n", args[0])
+			return
+		}
+	}
+
+	c.release()
+	batch, err := pubsub.FetchDeadLetters(ctx, c.broker, n, dlqIdleWait)
+	if err != nil {
+		fmt.Printf("Could not read dead letters: %v\n", err)
+		return
+	}
+	c.batch = batch
+
+	if len(batch.Letters) == 0 {
+		fmt.Println("No dead letters.")
+		return
+	}
+	for i, dl := range batch.Letters {
+		fmt.Printf("[%d] %s from queue %q (x%d)\n", i, dl.Reason, dl.Queue, dl.Count)
+		fmt.Printf("    exchange: %q, routing key: %q, content type: %s\n", dl.Exchange, dl.RoutingKey, dl.Delivery.ContentType)
+		fmt.Printf("    %s\n", describeDeadLetter(dl))
+	}
+}
+
+func (c *dlqCommand) settle(args []string, action func(int) error, verb string) {
+	if c.batch == nil {
+		fmt.Println("Run dlq list first.")
+		return
+	}
+	if len(args) == 0 {
+		fmt.Println("Specify message indexes or all.")
+		return
+	}
+
+	indexes := []int{}
+	if args[0] == "all" {
+		for i := range c.batch.Letters {
+			indexes = append(indexes, i)
+		}
+	} else {
+		for _, arg := range args {
+			i, err := strconv.Atoi(arg)
+			if err != nil {
+				fmt.Printf("error: %s is not a valid index\n", arg)
+				return
+			}
+			indexes = append(indexes, i)
+		}
+	}
+
+	for _, i := range indexes {
+		err := action(i)
+		if err != nil {
+			fmt.Printf("[%d] %v\n", i, err)
+			continue
+		}
+		fmt.Printf("[%d] %s\n", i, verb)
+	}
+}
+
+// shutdown releases any held dead letters when the server exits.
+func (c *dlqCommand) shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.release()
+}
+
+func (c *dlqCommand) release() {
+	if c.batch == nil {
+		return
+	}
+	c.batch.Release()
+	c.batch = nil
+}
+
+// describeDeadLetter decodes the body into the message type used for its
+// routing key, falling back to a generic value for JSON.
+func describeDeadLetter(dl pubsub.DeadLetter) string {
+	var v any
+	switch {
+	case strings.HasPrefix(dl.RoutingKey, routing.GameLogSlug):
+		v = &routing.GameLog{}
+	case strings.HasPrefix(dl.RoutingKey, routing.ArmyMovesPrefix):
+		v = &gamelogic.ArmyMove{}
+	case strings.HasPrefix(dl.RoutingKey, routing.WarRecognitionsPrefix):
+		v = &gamelogic.RecognitionOfWar{}
+	case dl.RoutingKey == routing.PauseKey:
+		v = &routing.PlayingState{}
+	default:
+		var generic any
+		v = &generic
+	}
+
+	err := dl.Decode(v)
+	if err != nil {
+		return fmt.Sprintf("<%d bytes, could not decode: %v>", len(dl.Delivery.Body), err)
+	}
+	return fmt.Sprintf("%+v", reflect.ValueOf(v).Elem().Interface())
+}
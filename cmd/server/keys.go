@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/filelock"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// keyIssuer hands out signing keys on a trust-on-first-use basis: the
+// first client to ask for a username's key gets it, and nobody can get it
+// again until an operator revokes it. Keys are saved so players keep them
+// across server restarts.
+//
+// Servers started by multiserver.sh share the keys file: issuing and
+// revoking keys happens under a lock on it, and each server reloads it
+// whenever it changes, so a key issued by one server is trusted by all.
+//
+// If players is nil anyone can claim an unused username. Otherwise keys
+// are only issued to the players listed, and keys saved for anyone else
+// are not trusted.
+type keyIssuer struct {
+	path    string
+	players map[string]bool
+
+	mu      sync.Mutex
+	keys    map[string][]byte
+	loaded  os.FileInfo
+	keyring *pubsub.Keyring
+}
+
+func newKeyIssuer(path string, players map[string]bool) (*keyIssuer, error) {
+	k := &keyIssuer{
+		path:    path,
+		players: players,
+		keys:    map[string][]byte{},
+		keyring: pubsub.NewKeyring(),
+	}
+	err := k.refresh()
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *keyIssuer) allowed(username string) bool {
+	return k.players == nil || k.players[username]
+}
+
+// refresh reloads the keys file if it changed since it was last loaded.
+// It must be called with k.mu held.
+func (k *keyIssuer) refresh() error {
+	info, err := os.Stat(k.path)
+	if os.IsNotExist(err) {
+		k.keys = map[string][]byte{}
+		k.keyring = pubsub.NewKeyring()
+		k.loaded = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read signing keys: %w", err)
+	}
+	if k.loaded != nil && info.ModTime().Equal(k.loaded.ModTime()) && info.Size() == k.loaded.Size() {
+		return nil
+	}
+
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return fmt.Errorf("could not read signing keys: %w", err)
+	}
+	keys := map[string][]byte{}
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return fmt.Errorf("could not parse signing keys: %w", err)
+	}
+	keyring := pubsub.NewKeyring()
+	for username, key := range keys {
+		if k.allowed(username) {
+			keyring.Add(username, key)
+		}
+	}
+	k.keys, k.keyring, k.loaded = keys, keyring, info
+	return nil
+}
+
+// update changes the saved keys with fn while holding the lock on the keys
+// file, so servers sharing it don't overwrite each other's changes.
+func (k *keyIssuer) update(fn func(keys map[string][]byte) error) error {
+	lock, err := filelock.Lock(k.path + ".lock")
+	if err != nil {
+		return fmt.Errorf("could not lock signing keys: %w", err)
+	}
+	defer lock.Close()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	err = k.refresh()
+	if err != nil {
+		return err
+	}
+	keys := maps.Clone(k.keys)
+	err = fn(keys)
+	if err != nil {
+		return err
+	}
+	err = k.save(keys)
+	if err != nil {
+		return err
+	}
+	return k.refresh()
+}
+
+func (k *keyIssuer) handleSigningKey(req routing.PlayerRequest) (routing.SigningKey, error) {
+	if req.Username == "" {
+		return routing.SigningKey{}, fmt.Errorf("username is required")
+	}
+	if !k.allowed(req.Username) {
+		return routing.SigningKey{}, fmt.Errorf("%q is not a player in this game", req.Username)
+	}
+	key := pubsub.NewSigningKey()
+	err := k.update(func(keys map[string][]byte) error {
+		if _, ok := keys[req.Username]; ok {
+			return fmt.Errorf("a signing key for %q has already been issued", req.Username)
+		}
+		keys[req.Username] = key
+		return nil
+	})
+	if err != nil {
+		return routing.SigningKey{}, err
+	}
+	return routing.SigningKey{Key: key}, nil
+}
+
+// revoke forgets username's signing key, so their messages are no longer
+// trusted and the next client to ask for the username's key gets a new
+// one. It's how a player who lost their key gets back in.
+func (k *keyIssuer) revoke(username string) error {
+	return k.update(func(keys map[string][]byte) error {
+		if _, ok := keys[username]; !ok {
+			return fmt.Errorf("no signing key has been issued for %q", username)
+		}
+		delete(keys, username)
+		return nil
+	})
+}
+
+func (k *keyIssuer) VerifySignature(ctx context.Context, signer string, content []byte, signature string) error {
+	k.mu.Lock()
+	err := k.refresh()
+	keyring := k.keyring
+	k.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return keyring.VerifySignature(ctx, signer, content, signature)
+}
+
+func (k *keyIssuer) handleVerifySignature(req routing.SignatureCheck) (routing.SignatureResult, error) {
+	err := k.VerifySignature(context.Background(), req.Signer, req.Content, req.Signature)
+	if errors.Is(err, pubsub.ErrUnknownSigner) || errors.Is(err, pubsub.ErrBadSignature) {
+		return routing.SignatureResult{Reason: err.Error()}, nil
+	}
+	if err != nil {
+		return routing.SignatureResult{}, err
+	}
+	return routing.SignatureResult{Valid: true}, nil
+}
+
+// save must be called with the keys file locked.
+func (k *keyIssuer) save(keys map[string][]byte) error {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return fmt.Errorf("could not save signing keys: %w", err)
+	}
+	return os.Rename(tmp, k.path)
+}
+
+// loadGameKey reads the secret war keys are derived from, creating it on
+// first run. It outlives the server so wars still queued after a restart
+// can be read.
+func loadGameKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read game key: %w", err)
+	}
+	key = pubsub.NewEncryptionKey()
+	err = os.WriteFile(path, key, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not save game key: %w", err)
+	}
+	return key, nil
+}
+
+// loadPlayers reads the usernames allowed to join the game, one per line.
+func loadPlayers(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read players: %w", err)
+	}
+	defer f.Close()
+	players := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		username := strings.TrimSpace(scanner.Text())
+		if username != "" && !strings.HasPrefix(username, "#") {
+			players[username] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read players: %w", err)
+	}
+	return players, nil
+}
+
+// warKey derives the key wars between two players are encrypted with from
+// the game key. Either player can be the attacker, so both orders give the
+// same key.
+func warKey(gameKey []byte, a, b string) []byte {
+	if a > b {
+		a, b = b, a
+	}
+	mac := hmac.New(sha256.New, gameKey)
+	mac.Write([]byte(a))
+	mac.Write([]byte{0})
+	mac.Write([]byte(b))
+	return mac.Sum(nil)
+}
+
+// handleWarKey gives the key for wars between two players to either of
+// them, and to nobody else, so other players can't see the armies a war
+// reveals. Requests must be signed, which tells it who is asking.
+func handleWarKey(gameKey []byte) func(pubsub.Message[routing.WarKeyRequest]) (routing.WarKey, error) {
+	return func(m pubsub.Message[routing.WarKeyRequest]) (routing.WarKey, error) {
+		req := m.Body
+		signer := pubsub.Signer(m.Delivery)
+		if signer != req.Attacker && signer != req.Defender {
+			return routing.WarKey{}, fmt.Errorf("%q is not at war with %q", signer, req.Defender)
+		}
+		if req.Attacker == req.Defender {
+			return routing.WarKey{}, fmt.Errorf("%q can't be at war with themselves", signer)
+		}
+		key := warKey(gameKey, req.Attacker, req.Defender)
+		// Registered so dlq can show dead-lettered wars.
+		_, err := pubsub.RegisterEncryptionKey(key)
+		if err != nil {
+			return routing.WarKey{}, err
+		}
+		return routing.WarKey{Key: key}, nil
+	}
+}
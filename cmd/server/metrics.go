@@ -0,0 +1,12 @@
+package main
+
+import (
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+var (
+	gameLogsWritten = pubsub.NewCounter("peril_game_logs_written_total",
+		"Game logs written to the log file.")
+	playersFlagged = pubsub.NewCounter("peril_players_flagged_total",
+		"Times a player was flagged for flooding game logs.")
+)
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// A player who goes over the game log rate limit offenderThreshold times
+// within offenderWindow is flagged in the game log.
+const (
+	offenderThreshold = 50
+	offenderWindow    = time.Minute
+)
+
+type offense struct {
+	count int
+	since time.Time
+}
+
+// offenders counts rate limit violations per player. Offenses whose window
+// has passed are swept once a window, so players who stop flooding, or
+// leave, are forgotten.
+type offenders struct {
+	mu        sync.Mutex
+	offenses  map[string]*offense
+	lastSweep time.Time
+}
+
+func newOffenders() *offenders {
+	return &offenders{offenses: map[string]*offense{}}
+}
+
+func (o *offenders) exceeded(ctx context.Context, username string, d pubsub.Delivery) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	if now.Sub(o.lastSweep) >= offenderWindow {
+		for u, off := range o.offenses {
+			if now.Sub(off.since) > offenderWindow {
+				delete(o.offenses, u)
+			}
+		}
+		o.lastSweep = now
+	}
+	off, ok := o.offenses[username]
+	if !ok || now.Sub(off.since) > offenderWindow {
+		off = &offense{since: now}
+		o.offenses[username] = off
+	}
+	off.count++
+	if off.count != offenderThreshold {
+		return
+	}
+
+	msg := fmt.Sprintf("%s was flagged for flooding game logs: %d messages over the limit in %s",
+		username, off.count, now.Sub(off.since).Round(time.Second))
+	logger := pubsub.Logger(ctx)
+	logger.Warn("player flagged for flooding game logs", "username", username, "over_limit", off.count, "window", now.Sub(off.since).Round(time.Second))
+	playersFlagged.Inc()
+	// WriteLog is slow, so don't hold up the consumer for it.
+	go func() {
+		err := gamelogic.WriteLog(routing.GameLog{
+			CurrentTime: now,
+			Message:     msg,
+			Username:    username,
+		})
+		if err != nil {
+			logger.Error("could not flag player", "username", username, "error", err)
+		}
+	}()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// A player counts as online if they made a request or sent a game log
+// within playerTimeout.
+const playerTimeout = 10 * time.Minute
+
+// serverState is what clients can ask the server about over RPC.
+type serverState struct {
+	mu       sync.Mutex
+	paused   bool
+	lastSeen map[string]time.Time
+}
+
+func newServerState() *serverState {
+	return &serverState{lastSeen: map[string]time.Time{}}
+}
+
+func (s *serverState) setPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = paused
+}
+
+func (s *serverState) seen(username string) {
+	if username == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen[username] = time.Now()
+}
+
+func (s *serverState) handlePauseState(req routing.PlayerRequest) (routing.PlayingState, error) {
+	s.seen(req.Username)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return routing.PlayingState{IsPaused: s.paused}, nil
+}
+
+func (s *serverState) handleOnlinePlayers(req routing.PlayerRequest) (routing.OnlinePlayers, error) {
+	s.seen(req.Username)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	online := routing.OnlinePlayers{Usernames: []string{}}
+	for username, t := range s.lastSeen {
+		if time.Since(t) > playerTimeout {
+			delete(s.lastSeen, username)
+			continue
+		}
+		online.Usernames = append(online.Usernames, username)
+	}
+	sort.Strings(online.Usernames)
+	return online, nil
+}
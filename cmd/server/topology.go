@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// verifyTopology prints every difference between routing.PerilTopology and
+// the broker and reports whether any were found. Objects the broker can't
+// check are listed but don't count as drift.
+func verifyTopology(ctx context.Context, v pubsub.Verifier) bool {
+	drifted := false
+	for _, d := range pubsub.VerifyTopology(ctx, v, routing.PerilTopology) {
+		if d.Unverifiable() {
+			fmt.Printf("? %s\n", d)
+			continue
+		}
+		drifted = true
+		fmt.Printf("✗ %s\n", d)
+	}
+	if drifted {
+		fmt.Println("The broker does not match the Peril topology.")
+	} else {
+		fmt.Println("The broker matches the Peril topology.")
+	}
+	return drifted
+}
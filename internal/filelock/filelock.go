@@ -0,0 +1,34 @@
+package filelock
+
+import (
+	"errors"
+	"os"
+)
+
+var ErrLocked = errors.New("filelock: file is locked by another process")
+
+// Lock waits for an exclusive lock on the file at path, creating it if it
+// doesn't exist. Closing the returned file releases the lock. Locks are
+// advisory: they only keep out processes that also take them.
+func Lock(path string) (*os.File, error) {
+	return lock(path, true)
+}
+
+// TryLock is Lock, but returns ErrLocked rather than waiting if another
+// process holds the lock.
+func TryLock(path string) (*os.File, error) {
+	return lock(path, false)
+}
+
+func lock(path string, wait bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = flock(f, wait)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -18,6 +18,7 @@ func PrintClientHelp() {
 	fmt.Println("    example:")
 	fmt.Println("    spawn europe infantry")
 	fmt.Println("* status")
+	fmt.Println("* players")
 	fmt.Println("* spam <n>")
 	fmt.Println("    example:")
 	fmt.Println("    spam 5")
@@ -42,6 +43,13 @@ func PrintServerHelp() {
 	fmt.Println("Possible commands:")
 	fmt.Println("* pause")
 	fmt.Println("* resume")
+	fmt.Println("* dlq list [n]")
+	fmt.Println("    example:")
+	fmt.Println("    dlq list 10")
+	fmt.Println("* dlq replay <index> <index>... | all")
+	fmt.Println("* dlq purge <index> <index>... | all")
+	fmt.Println("* dlq release")
+	fmt.Println("* revoke <username>")
 	fmt.Println("* quit")
 	fmt.Println("* help")
 }
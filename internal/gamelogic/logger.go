@@ -0,0 +1,29 @@
+package gamelogic
+
+import (
+	"log/slog"
+	"sync"
+)
+
+var (
+	loggerMu sync.RWMutex
+	logger   *slog.Logger
+)
+
+// SetLogger sets the logger game events are logged to. Game output meant
+// for the player is still printed to stdout. Until it is called events are
+// logged to slog.Default().
+func SetLogger(l *slog.Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	logger = l
+}
+
+func currentLogger() *slog.Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
@@ -14,9 +14,30 @@ const (
 	MoveOutcomeMakeWar
 )
 
-func (gs *GameState) HandleMove(move ArmyMove) MoveOutcome {
+func (o MoveOutcome) String() string {
+	switch o {
+	case MoveOutcomeSamePlayer:
+		return "same_player"
+	case MoveOutComeSafe:
+		return "safe"
+	case MoveOutcomeMakeWar:
+		return "war"
+	}
+	return "unknown"
+}
+
+func (gs *GameState) HandleMove(move ArmyMove) (outcome MoveOutcome) {
 	defer fmt.Println("------------------------")
 	player := gs.GetPlayerSnap()
+	defer func() {
+		currentLogger().Info("handled move",
+			"username", player.Username,
+			"mover", move.Player.Username,
+			"location", move.ToLocation,
+			"units", len(move.Units),
+			"outcome", outcome.String(),
+		)
+	}()
 
 	fmt.Println()
 	fmt.Println("==== Move Detected ====")
@@ -88,5 +109,6 @@ func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
 		Player:     gs.GetPlayerSnap(),
 	}
 	fmt.Printf("Moved %v units to %s\n", len(mv.Units), mv.ToLocation)
+	currentLogger().Debug("moved units", "username", mv.Player.Username, "location", mv.ToLocation, "units", len(mv.Units))
 	return mv, nil
 }
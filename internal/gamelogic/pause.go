@@ -8,6 +8,7 @@ import (
 
 func (gs *GameState) HandlePause(ps routing.PlayingState) {
 	defer fmt.Println("------------------------")
+	currentLogger().Info("handled pause", "username", gs.GetUsername(), "paused", ps.IsPaused)
 	fmt.Println()
 	if ps.IsPaused {
 		fmt.Println("==== Pause Detected ====")
@@ -30,5 +30,6 @@ func (gs *GameState) CommandSpawn(words []string) error {
 	})
 
 	fmt.Printf("Spawned a(n) %s in %s with id %v\n", rank, locationName, id)
+	currentLogger().Debug("spawned unit", "username", gs.GetUsername(), "unit_id", id, "rank", rank, "location", locationName)
 	return nil
 }
@@ -0,0 +1,68 @@
+package gamelogic
+
+import (
+	"errors"
+	"fmt"
+)
+
+func (u Unit) Validate() error {
+	if _, ok := getAllRanks()[u.Rank]; !ok {
+		return fmt.Errorf("unit %d has invalid rank %q", u.ID, u.Rank)
+	}
+	if _, ok := getAllLocations()[u.Location]; !ok {
+		return fmt.Errorf("unit %d is at invalid location %q", u.ID, u.Location)
+	}
+	return nil
+}
+
+func (p Player) Validate() error {
+	if p.Username == "" {
+		return errors.New("player has no username")
+	}
+	for id, unit := range p.Units {
+		if unit.ID != id {
+			return fmt.Errorf("unit %d is stored under ID %d", unit.ID, id)
+		}
+		if err := unit.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (move ArmyMove) Validate() error {
+	if err := move.Player.Validate(); err != nil {
+		return err
+	}
+	if _, ok := getAllLocations()[move.ToLocation]; !ok {
+		return fmt.Errorf("move to invalid location %q", move.ToLocation)
+	}
+	if len(move.Units) == 0 {
+		return errors.New("move has no units")
+	}
+	for _, unit := range move.Units {
+		if err := unit.Validate(); err != nil {
+			return err
+		}
+		if _, ok := move.Player.Units[unit.ID]; !ok {
+			return fmt.Errorf("unit %d doesn't belong to %s", unit.ID, move.Player.Username)
+		}
+		if unit.Location != move.ToLocation {
+			return fmt.Errorf("unit %d is at %q, not %q", unit.ID, unit.Location, move.ToLocation)
+		}
+	}
+	return nil
+}
+
+func (rw RecognitionOfWar) Validate() error {
+	if err := rw.Attacker.Validate(); err != nil {
+		return fmt.Errorf("attacker: %w", err)
+	}
+	if err := rw.Defender.Validate(); err != nil {
+		return fmt.Errorf("defender: %w", err)
+	}
+	if rw.Attacker.Username == rw.Defender.Username {
+		return errors.New("a player can't go to war with themselves")
+	}
+	return nil
+}
@@ -14,6 +14,22 @@ const (
 	WarOutcomeDraw
 )
 
+func (o WarOutcome) String() string {
+	switch o {
+	case WarOutcomeNotInvolved:
+		return "not_involved"
+	case WarOutcomeNoUnits:
+		return "no_units"
+	case WarOutcomeYouWon:
+		return "won"
+	case WarOutcomeOpponentWon:
+		return "lost"
+	case WarOutcomeDraw:
+		return "draw"
+	}
+	return "unknown"
+}
+
 func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner string, loser string) {
 	defer fmt.Println("------------------------")
 	fmt.Println()
@@ -21,6 +37,16 @@ func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner
 	fmt.Printf("%s has declared war on %s!\n", rw.Attacker.Username, rw.Defender.Username)
 
 	player := gs.GetPlayerSnap()
+	defer func() {
+		currentLogger().Info("handled war",
+			"username", player.Username,
+			"attacker", rw.Attacker.Username,
+			"defender", rw.Defender.Username,
+			"outcome", outcome.String(),
+			"winner", winner,
+			"loser", loser,
+		)
+	}()
 
 	if player.Username == rw.Defender.Username {
 		fmt.Printf("%s, you published the war.\n", player.Username)
@@ -0,0 +1,474 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type AMQPBroker struct {
+	conn      *amqp.Connection
+	mu        sync.Mutex
+	ch        *amqp.Channel
+	confirmCh *amqp.Channel
+}
+
+func NewAMQPBroker(conn *amqp.Connection) (*AMQPBroker, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return &AMQPBroker{
+		conn: conn,
+		ch:   ch,
+	}, nil
+}
+
+// Close releases the publishing channel. The connection is owned by the
+// caller and is left open.
+func (b *AMQPBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.confirmCh != nil {
+		b.confirmCh.Close()
+	}
+	return b.ch.Close()
+}
+
+// channel returns the publishing channel, reopening it if the broker closed
+// it after a channel-level error such as publishing to a missing exchange.
+func (b *AMQPBroker) channel() (*amqp.Channel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.ch.IsClosed() {
+		return b.ch, nil
+	}
+	ch, err := b.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	b.ch = ch
+	return ch, nil
+}
+
+// confirmChannel returns a channel in confirm mode, opening it on first use.
+// Confirms are kept off the regular publishing channel so that callers who
+// don't ask for them don't pay for the extra round trip.
+func (b *AMQPBroker) confirmChannel() (*amqp.Channel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.confirmCh != nil && !b.confirmCh.IsClosed() {
+		return b.confirmCh, nil
+	}
+	ch, err := b.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	err = ch.Confirm(false)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	b.confirmCh = ch
+	return ch, nil
+}
+
+func (b *AMQPBroker) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+	ch, err := b.channel()
+	if err != nil {
+		return err
+	}
+	return ch.PublishWithContext(
+		ctx,
+		exchange,
+		key,
+		false,
+		false,
+		toAMQPPublishing(msg),
+	)
+}
+
+func (b *AMQPBroker) PublishConfirmed(ctx context.Context, exchange, key string, msg Publishing) error {
+	ch, err := b.confirmChannel()
+	if err != nil {
+		return err
+	}
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		exchange,
+		key,
+		false,
+		false,
+		toAMQPPublishing(msg),
+	)
+	if err != nil {
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	return confirmError(ch, acked)
+}
+
+// confirmError returns the error for a confirm that wasn't an ack. Losing
+// the channel settles every outstanding confirm as a nack, which means the
+// broker never got to decide, not that it refused the message.
+func confirmError(ch *amqp.Channel, acked bool) error {
+	if acked {
+		return nil
+	}
+	if ch.IsClosed() {
+		return amqp.ErrClosed
+	}
+	return ErrPublishNacked
+}
+
+// PublishBatch publishes every message before waiting for any confirms, so
+// a confirmed batch costs one round trip rather than one per message.
+func (b *AMQPBroker) PublishBatch(ctx context.Context, exchange, key string, msgs []Publishing, confirm bool) []error {
+	errs := make([]error, len(msgs))
+	if !confirm {
+		ch, err := b.channel()
+		for i, msg := range msgs {
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			errs[i] = ch.PublishWithContext(ctx, exchange, key, false, false, toAMQPPublishing(msg))
+		}
+		return errs
+	}
+
+	ch, err := b.confirmChannel()
+	confirmations := make([]*amqp.DeferredConfirmation, len(msgs))
+	for i, msg := range msgs {
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		confirmations[i], errs[i] = ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, toAMQPPublishing(msg))
+	}
+	for i, confirmation := range confirmations {
+		if confirmation == nil {
+			continue
+		}
+		acked, err := confirmation.WaitContext(ctx)
+		if err != nil {
+			errs[i] = err
+		} else {
+			errs[i] = confirmError(ch, acked)
+		}
+	}
+	return errs
+}
+
+func (b *AMQPBroker) Consume(
+	ctx context.Context,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	prefetch int,
+) (<-chan Delivery, error) {
+	return b.ConsumeQueue(ctx, simpleQueueSpec(queueName, queueType), exchange, key, prefetch)
+}
+
+func (b *AMQPBroker) ConsumeQueue(ctx context.Context, spec QueueSpec, exchange, key string, prefetch int) (<-chan Delivery, error) {
+	ch, q, err := declareAndBindSpec(b.conn, exchange, spec, key)
+	if err != nil {
+		return nil, err
+	}
+	err = ch.Qos(prefetch, 0, false)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	deliveries, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	out := make(chan Delivery)
+	go func() {
+		// The channel stays open until every delivery handed out has been
+		// acked or nacked, so that a cancelled subscriber can finish the
+		// message it is working on. Anything prefetched but not handed out
+		// is requeued by the broker when the channel closes.
+		var inflight sync.WaitGroup
+		defer ch.Close()
+		defer inflight.Wait()
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case d, ok := <-deliveries:
+				if !ok {
+					return
+				}
+				inflight.Add(1)
+				select {
+				case out <- fromAMQPDelivery(d, newAMQPAcknowledger(d.Acknowledger, inflight.Done)):
+				case <-ctx.Done():
+					d.Nack(false, true)
+					inflight.Done()
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// withChannel runs fn on a short-lived channel. Declarations that fail
+// close the channel they were made on, so they are kept off the
+// publishing channel.
+func (b *AMQPBroker) withChannel(fn func(ch *amqp.Channel) error) error {
+	ch, err := b.conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return fn(ch)
+}
+
+func (b *AMQPBroker) DeclareQueue(ctx context.Context, spec QueueSpec) error {
+	return b.withChannel(func(ch *amqp.Channel) error {
+		_, err := ch.QueueDeclare(
+			spec.Name,
+			spec.Durable,
+			spec.AutoDelete,
+			spec.Exclusive,
+			false,
+			toAMQPTable(spec.Args),
+		)
+		return err
+	})
+}
+
+func (b *AMQPBroker) DeclareExchange(ctx context.Context, name, kind string, durable bool) error {
+	return b.withChannel(func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclare(name, kind, durable, false, false, false, nil)
+	})
+}
+
+func (b *AMQPBroker) BindQueue(ctx context.Context, queue, key, exchange string) error {
+	return b.withChannel(func(ch *amqp.Channel) error {
+		return ch.QueueBind(queue, key, exchange, false, nil)
+	})
+}
+
+// CheckExchange first checks the exchange exists with a passive declare,
+// which doesn't compare properties, then redeclares it with the expected
+// ones. Redeclaring an existing exchange is a no-op when they match and a
+// precondition failure when they don't.
+func (b *AMQPBroker) CheckExchange(ctx context.Context, name, kind string, durable bool) error {
+	err := b.withChannel(func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclarePassive(name, kind, durable, false, false, false, nil)
+	})
+	if err != nil {
+		return fromAMQPError(err, ErrExchangeNotFound)
+	}
+	return fromAMQPError(b.DeclareExchange(ctx, name, kind, durable), ErrExchangeNotFound)
+}
+
+func (b *AMQPBroker) CheckQueue(ctx context.Context, spec QueueSpec) error {
+	err := b.withChannel(func(ch *amqp.Channel) error {
+		_, err := ch.QueueDeclarePassive(spec.Name, spec.Durable, spec.AutoDelete, spec.Exclusive, false, toAMQPTable(spec.Args))
+		return err
+	})
+	if err != nil {
+		return fromAMQPError(err, ErrQueueNotFound)
+	}
+	return fromAMQPError(b.DeclareQueue(ctx, spec), ErrQueueNotFound)
+}
+
+// CheckBinding always fails: AMQP 0-9-1 has no way to list bindings.
+func (b *AMQPBroker) CheckBinding(ctx context.Context, queue, key, exchange string) error {
+	return fmt.Errorf("%w: bindings can not be listed over AMQP", ErrUnverifiable)
+}
+
+func DeclareAndBind(
+	conn *amqp.Connection,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType, // an enum to represent "durable", "transient" or "shared"
+) (*amqp.Channel, amqp.Queue, error) {
+	return declareAndBindSpec(conn, exchange, simpleQueueSpec(queueName, queueType), key)
+}
+
+func declareAndBindSpec(conn *amqp.Connection, exchange string, spec QueueSpec, key string) (*amqp.Channel, amqp.Queue, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, amqp.Queue{}, err
+	}
+
+	queue, err := ch.QueueDeclare(
+		spec.Name,
+		spec.Durable,
+		spec.AutoDelete,
+		spec.Exclusive,
+		false,
+		toAMQPTable(spec.Args),
+	)
+
+	if err != nil {
+		ch.Close()
+		return nil, amqp.Queue{}, err
+	}
+
+	// Every queue is already bound to the default exchange by its name,
+	// and RabbitMQ refuses explicit bindings to it.
+	if exchange == "" {
+		return ch, queue, nil
+	}
+
+	err = ch.QueueBind(
+		queue.Name,
+		key,
+		exchange,
+		false,
+		nil,
+	)
+
+	if err != nil {
+		ch.Close()
+		return nil, amqp.Queue{}, err
+	}
+
+	return ch, queue, nil
+}
+
+type amqpAcknowledger struct {
+	acker   amqp.Acknowledger
+	once    sync.Once
+	settled func()
+}
+
+func newAMQPAcknowledger(acker amqp.Acknowledger, settled func()) *amqpAcknowledger {
+	return &amqpAcknowledger{
+		acker:   acker,
+		settled: settled,
+	}
+}
+
+func (a *amqpAcknowledger) Ack(tag uint64) error {
+	defer a.once.Do(a.settled)
+	return a.acker.Ack(tag, false)
+}
+
+func (a *amqpAcknowledger) Nack(tag uint64, requeue bool) error {
+	defer a.once.Do(a.settled)
+	return a.acker.Nack(tag, false, requeue)
+}
+
+func toAMQPPublishing(msg Publishing) amqp.Publishing {
+	return amqp.Publishing{
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		MessageId:       msg.MessageID,
+		CorrelationId:   msg.CorrelationID,
+		AppId:           msg.AppID,
+		ReplyTo:         msg.ReplyTo,
+		Timestamp:       msg.Timestamp,
+		Headers:         toAMQPTable(msg.Headers),
+		Body:            msg.Body,
+	}
+}
+
+func fromAMQPDelivery(d amqp.Delivery, acker Acknowledger) Delivery {
+	return Delivery{
+		Publishing: Publishing{
+			ContentType:     d.ContentType,
+			ContentEncoding: d.ContentEncoding,
+			MessageID:       d.MessageId,
+			CorrelationID:   d.CorrelationId,
+			AppID:           d.AppId,
+			ReplyTo:         d.ReplyTo,
+			Timestamp:       d.Timestamp,
+			Headers:         fromAMQPTable(d.Headers),
+			Body:            d.Body,
+		},
+		Exchange:     d.Exchange,
+		RoutingKey:   d.RoutingKey,
+		DeliveryTag:  d.DeliveryTag,
+		Redelivered:  d.Redelivered,
+		Acknowledger: acker,
+	}
+}
+
+func toAMQPTable(t Table) amqp.Table {
+	if t == nil {
+		return nil
+	}
+	out := amqp.Table{}
+	for k, v := range t {
+		out[k] = toAMQPValue(v)
+	}
+	return out
+}
+
+func toAMQPValue(v any) any {
+	switch v := v.(type) {
+	case Table:
+		return toAMQPTable(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = toAMQPValue(item)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+func fromAMQPTable(t amqp.Table) Table {
+	if t == nil {
+		return nil
+	}
+	out := Table{}
+	for k, v := range t {
+		out[k] = fromAMQPValue(v)
+	}
+	return out
+}
+
+func fromAMQPValue(v any) any {
+	switch v := v.(type) {
+	case amqp.Table:
+		return fromAMQPTable(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = fromAMQPValue(item)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+func fromAMQPError(err error, notFound error) error {
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) {
+		return err
+	}
+	switch amqpErr.Code {
+	case amqp.NotFound:
+		return fmt.Errorf("%w: %s", notFound, amqpErr.Reason)
+	case amqp.PreconditionFailed:
+		return fmt.Errorf("%w: %s", ErrPreconditionFailed, amqpErr.Reason)
+	case amqp.ResourceLocked:
+		return fmt.Errorf("%w: %s", ErrResourceLocked, amqpErr.Reason)
+	default:
+		return err
+	}
+}
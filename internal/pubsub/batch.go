@@ -0,0 +1,101 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+)
+
+// BatchPublisher is implemented by publishers that can send many messages
+// more cheaply than one Publish call each. The returned slice has one
+// entry per message, nil for those that were published (and, with
+// confirm, acked by the broker).
+type BatchPublisher interface {
+	PublishBatch(ctx context.Context, exchange, key string, msgs []Publishing, confirm bool) []error
+}
+
+// BatchError reports which messages of a batch failed. Errs has one entry
+// per value passed to PublishBatch, nil for those that succeeded.
+type BatchError struct {
+	Errs []error
+}
+
+func (e *BatchError) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e.Errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("pubsub: %d of %d messages failed to publish: %v", failed, len(e.Errs), first)
+}
+
+func (e *BatchError) Unwrap() []error {
+	return e.Errs
+}
+
+// PublishBatch marshals every value in vals with the codec registered for
+// contentType and publishes them to exchange with key. Each message gets
+// its own envelope. With WithConfirm it waits for every message to be
+// confirmed; publishers that implement BatchPublisher wait for the whole
+// batch at once rather than one message at a time, and without a deadline
+// on the context the whole batch gets five seconds. If any message fails
+// the error is a *BatchError.
+func PublishBatch[T any](ctx context.Context, pub Publisher, contentType, exchange, key string, vals []T, opts ...PublishOption) error {
+	codec, err := codecFor(contentType)
+	if err != nil {
+		return err
+	}
+	o := newPublishOptions(opts)
+
+	errs := make([]error, len(vals))
+	msgs := make([]Publishing, 0, len(vals))
+	index := make([]int, 0, len(vals))
+	for i, val := range vals {
+		body, err := codec.Marshal(val)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		msg, err := newPublishing(contentType, body, o)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		msgs = append(msgs, msg)
+		index = append(index, i)
+	}
+
+	if bp, ok := pub.(BatchPublisher); ok {
+		spans := make([]*Span, len(msgs))
+		for j := range msgs {
+			_, spans[j] = startPublishSpan(ctx, exchange, key, &msgs[j])
+		}
+		if o.confirm {
+			var cancel context.CancelFunc
+			ctx, cancel = withConfirmTimeout(ctx)
+			defer cancel()
+		}
+		for j, err := range bp.PublishBatch(ctx, exchange, key, msgs, o.confirm) {
+			recordPublish(exchange, key, err)
+			if spans[j] != nil {
+				spans[j].finish(err)
+			}
+			errs[index[j]] = err
+		}
+	} else {
+		for j, msg := range msgs {
+			errs[index[j]] = publish(ctx, pub, exchange, key, msg, opts)
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return &BatchError{Errs: errs}
+		}
+	}
+	return nil
+}
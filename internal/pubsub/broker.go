@@ -0,0 +1,135 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+var (
+	ErrPublishNacked      = errors.New("pubsub: publish was nacked by the broker")
+	ErrExchangeNotFound   = errors.New("pubsub: exchange not found")
+	ErrQueueNotFound      = errors.New("pubsub: queue not found")
+	ErrBindingNotFound    = errors.New("pubsub: binding not found")
+	ErrPreconditionFailed = errors.New("pubsub: precondition failed")
+	ErrResourceLocked     = errors.New("pubsub: resource locked")
+	ErrUnverifiable       = errors.New("pubsub: broker can not verify this")
+)
+
+type Table map[string]any
+
+func tableInt(t Table, key string) (int64, bool) {
+	switch v := t[key].(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	default:
+		return 0, false
+	}
+}
+
+type Publishing struct {
+	ContentType     string
+	ContentEncoding string
+	MessageID       string
+	CorrelationID   string
+	AppID           string
+	ReplyTo         string
+	Timestamp       time.Time
+	Headers         Table
+	Body            []byte
+}
+
+type Delivery struct {
+	Publishing
+	Exchange     string
+	RoutingKey   string
+	DeliveryTag  uint64
+	Redelivered  bool
+	Acknowledger Acknowledger
+}
+
+type Acknowledger interface {
+	Ack(tag uint64) error
+	Nack(tag uint64, requeue bool) error
+}
+
+func (d Delivery) Ack() error {
+	return d.Acknowledger.Ack(d.DeliveryTag)
+}
+
+func (d Delivery) Nack(requeue bool) error {
+	return d.Acknowledger.Nack(d.DeliveryTag, requeue)
+}
+
+// Publisher sends a message to an exchange. Implementations must be safe
+// for concurrent use.
+type Publisher interface {
+	Publish(ctx context.Context, exchange, key string, msg Publishing) error
+}
+
+// Subscriber declares a queue, binds it to an exchange and streams its
+// deliveries until ctx is cancelled or the underlying transport goes away.
+// Queues consumed from the default exchange "" are not bound; the broker
+// routes to them by name. At most prefetch deliveries are outstanding at
+// once; zero means no limit.
+type Subscriber interface {
+	Consume(ctx context.Context, exchange, queueName, key string, queueType SimpleQueueType, prefetch int) (<-chan Delivery, error)
+}
+
+type QueueSpec struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Args       Table
+}
+
+// QueueConsumer is implemented by brokers that can consume from a queue
+// declared with an explicit spec, for queues whose arguments don't follow
+// from a SimpleQueueType. Queues consumed through Subscriber always
+// dead-letter to peril_dlx.
+type QueueConsumer interface {
+	ConsumeQueue(ctx context.Context, spec QueueSpec, exchange, key string, prefetch int) (<-chan Delivery, error)
+}
+
+// simpleQueueSpec is the spec Subscriber.Consume declares queueName with.
+func simpleQueueSpec(queueName string, queueType SimpleQueueType) QueueSpec {
+	return QueueSpec{
+		Name:       queueName,
+		Durable:    queueType == Durable,
+		AutoDelete: queueType != Durable,
+		Exclusive:  queueType == Transient,
+		Args: Table{
+			"x-dead-letter-exchange": routing.ExchangePerilDLX,
+		},
+	}
+}
+
+// QueueDeclarer is implemented by brokers that can declare a queue without
+// consuming from it or binding it to an exchange.
+type QueueDeclarer interface {
+	DeclareQueue(ctx context.Context, spec QueueSpec) error
+}
+
+// Confirmer is implemented by publishers that can wait for the broker to
+// take responsibility for a message. PublishConfirmed returns nil only once
+// the broker has acked the publish and ErrPublishNacked if it refused it.
+type Confirmer interface {
+	PublishConfirmed(ctx context.Context, exchange, key string, msg Publishing) error
+}
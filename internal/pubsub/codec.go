@@ -0,0 +1,117 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"sync"
+)
+
+const (
+	ContentTypeJSON = "application/json"
+	ContentTypeGob  = "application/gob"
+)
+
+var ErrUnknownContentType = errors.New("pubsub: no codec registered for content type")
+
+// Codec marshals values for one content type.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		ContentTypeJSON: jsonCodec{},
+		ContentTypeGob:  gobCodec{},
+	}
+)
+
+// RegisterCodec makes a codec available to Publish and Subscribe under the
+// given content type, replacing any codec already registered for it.
+func RegisterCodec(contentType string, c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[mediaType(contentType)] = c
+}
+
+// Unmarshal decodes data with the codec registered for contentType.
+func Unmarshal(contentType string, data []byte, v any) error {
+	codec, err := codecFor(contentType)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(data, v)
+}
+
+// unmarshalPublishing decrypts and decompresses p's body and decodes it
+// into v, using defaultContentType if p doesn't set a content type.
+func unmarshalPublishing(p Publishing, defaultContentType string, v any) error {
+	contentType := p.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	codec, err := codecFor(contentType)
+	if err != nil {
+		return err
+	}
+	body, err := decrypt(p)
+	if err != nil {
+		return err
+	}
+	body, err = decompress(p.ContentEncoding, body)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(body, v)
+}
+
+func codecFor(contentType string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[mediaType(contentType)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownContentType, contentType)
+	}
+	return c, nil
+}
+
+// mediaType strips parameters such as charset from a content type.
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return mt
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	return dec.Decode(v)
+}
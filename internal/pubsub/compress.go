@@ -0,0 +1,161 @@
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// MaxDecompressedSize caps how large a compressed body may grow when it is
+// decompressed, so a small message can't expand to exhaust memory.
+const MaxDecompressedSize = 8 << 20
+
+var (
+	ErrUnknownContentEncoding = errors.New("pubsub: no compressor registered for content encoding")
+	ErrBodyTooLarge           = fmt.Errorf("pubsub: decompressed body is larger than %d bytes", MaxDecompressedSize)
+)
+
+// Compressor compresses message bodies for one content encoding.
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{
+		EncodingGzip: gzipCompressor{},
+		EncodingZstd: newZstdCompressor(),
+	}
+)
+
+// RegisterCompressor makes a compressor available to WithCompression and
+// Subscribe under the given content encoding, replacing any compressor
+// already registered for it.
+func RegisterCompressor(encoding string, c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[encoding] = c
+}
+
+// WithCompression compresses bodies of at least threshold bytes with the
+// compressor registered for encoding and records it in the message's
+// content encoding. Smaller bodies are sent as they are, since compressing
+// them costs more than it saves.
+func WithCompression(encoding string, threshold int) PublishOption {
+	return func(o *publishOptions) {
+		o.encoding = encoding
+		o.compressAbove = threshold
+	}
+}
+
+func compressorFor(encoding string) (Compressor, error) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[encoding]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownContentEncoding, encoding)
+	}
+	return c, nil
+}
+
+// compress returns body compressed as o asks, along with the content
+// encoding to record.
+func compress(body []byte, o publishOptions) ([]byte, string, error) {
+	if o.encoding == "" || len(body) < o.compressAbove {
+		return body, "", nil
+	}
+	c, err := compressorFor(o.encoding)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err = c.Compress(body)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, o.encoding, nil
+}
+
+func decompress(encoding string, body []byte) ([]byte, error) {
+	if encoding == "" || encoding == "identity" {
+		return body, nil
+	}
+	c, err := compressorFor(encoding)
+	if err != nil {
+		return nil, err
+	}
+	return c.Decompress(body)
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	body, err := io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MaxDecompressedSize {
+		return nil, ErrBodyTooLarge
+	}
+	return body, nil
+}
+
+// zstdCompressor shares one encoder and decoder; both are safe for
+// concurrent use through EncodeAll and DecodeAll.
+type zstdCompressor struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func newZstdCompressor() zstdCompressor {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxDecompressedSize))
+	if err != nil {
+		panic(err)
+	}
+	return zstdCompressor{enc: enc, dec: dec}
+}
+
+func (c zstdCompressor) Compress(data []byte) ([]byte, error) {
+	return c.enc.EncodeAll(data, nil), nil
+}
+
+func (c zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	body, err := c.dec.DecodeAll(data, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return nil, ErrBodyTooLarge
+	}
+	return body, err
+}
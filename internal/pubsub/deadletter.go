@@ -0,0 +1,256 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// Headers set on deliveries that were rejected with a reason rather than
+// dead-lettered by the broker.
+const (
+	RejectionReasonHeader    = "x-rejection-reason"
+	OriginalQueueHeader      = "x-original-queue"
+	OriginalExchangeHeader   = "x-original-exchange"
+	OriginalRoutingKeyHeader = "x-original-routing-key"
+	RejectedAtHeader         = "x-rejected-at"
+)
+
+var ErrDeadLetterSettled = errors.New("pubsub: dead letter was already replayed or purged")
+
+type rejectionKey struct{}
+
+type rejection struct {
+	reason string
+}
+
+// Reject returns NackDiscard and records why, so the delivery reaches the
+// dead-letter queue with the reason in its headers. It can be called from
+// middleware or from anywhere a subscription's handler context reaches.
+func Reject(ctx context.Context, reason string) AckType {
+	if r, ok := ctx.Value(rejectionKey{}).(*rejection); ok {
+		r.reason = reason
+	}
+	return NackDiscard
+}
+
+func withRejection(ctx context.Context) (context.Context, *rejection) {
+	r := &rejection{}
+	return context.WithValue(ctx, rejectionKey{}, r), r
+}
+
+// rejecter dead-letters deliveries by publishing them to the dead-letter
+// exchange itself, which unlike a nack lets it add headers.
+type rejecter struct {
+	pub       Publisher
+	queueName string
+}
+
+func newRejecter(sub Subscriber, queueName string) *rejecter {
+	pub, ok := sub.(Publisher)
+	if !ok {
+		return nil
+	}
+	return &rejecter{pub: pub, queueName: queueName}
+}
+
+func (r *rejecter) reject(ctx context.Context, d Delivery, reason string) {
+	msg := d.Publishing
+	msg.Headers = cloneTable(d.Headers)
+	msg.Headers[RejectionReasonHeader] = reason
+	msg.Headers[OriginalQueueHeader] = r.queueName
+	msg.Headers[OriginalExchangeHeader] = d.Exchange
+	msg.Headers[OriginalRoutingKeyHeader] = d.RoutingKey
+	msg.Headers[RejectedAtHeader] = time.Now().UTC().Format(time.RFC3339)
+	err := publish(ctx, r.pub, routing.ExchangePerilDLX, d.RoutingKey, msg, []PublishOption{WithConfirm()})
+	if err != nil {
+		Logger(ctx).Error("could not dead-letter rejected message, discarding", "reason", reason, "error", err)
+		d.Nack(false)
+		return
+	}
+	Logger(ctx).Warn("rejected message", "reason", reason)
+	d.Ack()
+}
+
+// DeadLetter is a message taken from the dead-letter queue together with
+// where it came from and why it was dead-lettered.
+type DeadLetter struct {
+	Delivery   Delivery
+	Reason     string
+	Queue      string
+	Exchange   string
+	RoutingKey string
+	Count      int64
+	Time       time.Time
+}
+
+// Decode unmarshals the dead-lettered body with the codec for its content
+// type.
+func (dl DeadLetter) Decode(v any) error {
+	return unmarshalPublishing(dl.Delivery.Publishing, "", v)
+}
+
+// DeadLetterBatch holds dead letters fetched from routing.DeadLetterQueue.
+// They stay unacknowledged, and so invisible to other inspectors, until
+// they are replayed, purged or the batch is released.
+type DeadLetterBatch struct {
+	Letters []DeadLetter
+
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	settled []bool
+}
+
+// FetchDeadLetters takes up to max messages from the dead-letter queue,
+// returning early once no new message has arrived for idle. The queue has
+// no dead-letter exchange of its own, since discarding from it would loop
+// straight back into it, so sub must implement QueueConsumer.
+func FetchDeadLetters(ctx context.Context, sub Subscriber, max int, idle time.Duration) (*DeadLetterBatch, error) {
+	qc, ok := sub.(QueueConsumer)
+	if !ok {
+		return nil, errors.New("pubsub: subscriber can not consume the dead-letter queue")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	deliveries, err := qc.ConsumeQueue(ctx, QueueSpec{Name: routing.DeadLetterQueue, Durable: true}, routing.ExchangePerilDLX, "#", max)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	b := &DeadLetterBatch{cancel: cancel}
+collect:
+	for len(b.Letters) < max {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				break collect
+			}
+			b.Letters = append(b.Letters, parseDeadLetter(d))
+			b.settled = append(b.settled, false)
+		case <-time.After(idle):
+			break collect
+		case <-ctx.Done():
+			break collect
+		}
+	}
+	return b, nil
+}
+
+// Replay republishes a dead letter to the exchange and routing key it was
+// originally published with and removes it from the dead-letter queue.
+func (b *DeadLetterBatch) Replay(ctx context.Context, pub Publisher, i int) error {
+	dl, err := b.take(i)
+	if err != nil {
+		return err
+	}
+
+	key := dl.RoutingKey
+	if dl.Exchange == "" {
+		key = dl.Queue
+	}
+	msg := dl.Delivery.Publishing
+	msg.Headers = Table{}
+	for k, v := range dl.Delivery.Headers {
+		if k == "x-death" || k == RejectionReasonHeader || k == RejectedAtHeader ||
+			strings.HasPrefix(k, "x-first-death-") || strings.HasPrefix(k, "x-last-death-") ||
+			strings.HasPrefix(k, "x-retry-") || strings.HasPrefix(k, "x-original-") {
+			continue
+		}
+		msg.Headers[k] = v
+	}
+	err = publish(ctx, pub, dl.Exchange, key, msg, []PublishOption{WithConfirm()})
+	if err != nil {
+		b.untake(i)
+		return err
+	}
+	return dl.Delivery.Ack()
+}
+
+// Purge drops a dead letter for good.
+func (b *DeadLetterBatch) Purge(i int) error {
+	dl, err := b.take(i)
+	if err != nil {
+		return err
+	}
+	return dl.Delivery.Ack()
+}
+
+// Release puts every dead letter that wasn't replayed or purged back on
+// the dead-letter queue and stops consuming from it.
+func (b *DeadLetterBatch) Release() {
+	for i := range b.Letters {
+		dl, err := b.take(i)
+		if err != nil {
+			continue
+		}
+		dl.Delivery.Nack(true)
+	}
+	b.cancel()
+}
+
+func (b *DeadLetterBatch) take(i int) (DeadLetter, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if i < 0 || i >= len(b.Letters) {
+		return DeadLetter{}, fmt.Errorf("pubsub: no dead letter at index %d", i)
+	}
+	if b.settled[i] {
+		return DeadLetter{}, ErrDeadLetterSettled
+	}
+	b.settled[i] = true
+	return b.Letters[i], nil
+}
+
+func (b *DeadLetterBatch) untake(i int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.settled[i] = false
+}
+
+// parseDeadLetter reads the x-death header RabbitMQ adds when it
+// dead-letters a message. The most recent death comes first. Messages that
+// went through a retry queue carry their original exchange and routing key
+// in the retry headers instead, and messages rejected with a reason carry
+// everything in the rejection headers.
+func parseDeadLetter(d Delivery) DeadLetter {
+	dl := DeadLetter{
+		Delivery:   d,
+		Exchange:   d.Exchange,
+		RoutingKey: d.RoutingKey,
+	}
+	deaths, _ := d.Headers["x-death"].([]any)
+	if len(deaths) > 0 {
+		if death, ok := deaths[0].(Table); ok {
+			dl.Reason, _ = death["reason"].(string)
+			dl.Queue, _ = death["queue"].(string)
+			dl.Exchange, _ = death["exchange"].(string)
+			dl.Count, _ = tableInt(death, "count")
+			dl.Time, _ = death["time"].(time.Time)
+			if keys, ok := death["routing-keys"].([]any); ok && len(keys) > 0 {
+				dl.RoutingKey, _ = keys[0].(string)
+			}
+		}
+	}
+	if exchange, ok := d.Headers[RetryExchangeHeader].(string); ok {
+		dl.Exchange = exchange
+	}
+	if key, ok := d.Headers[RetryRoutingKeyHeader].(string); ok {
+		dl.RoutingKey = key
+	}
+	if reason, ok := d.Headers[RejectionReasonHeader].(string); ok {
+		dl.Reason = "rejected: " + reason
+		dl.Queue, _ = d.Headers[OriginalQueueHeader].(string)
+		dl.Exchange, _ = d.Headers[OriginalExchangeHeader].(string)
+		dl.RoutingKey, _ = d.Headers[OriginalRoutingKeyHeader].(string)
+		dl.Count = 1
+		if at, ok := d.Headers[RejectedAtHeader].(string); ok {
+			dl.Time, _ = time.Parse(time.RFC3339, at)
+		}
+	}
+	return dl
+}
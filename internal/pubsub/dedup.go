@@ -0,0 +1,243 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/filelock"
+)
+
+// DedupStore remembers the IDs of messages that have been handled.
+type DedupStore interface {
+	Seen(id string) (bool, error)
+	Mark(id string) error
+}
+
+// Dedup skips and acks deliveries whose message ID is already in store.
+// A delivery is marked once its handler settles it for good with Ack or
+// NackDiscard; one that is requeued may still be handled again.
+// Deliveries without a message ID always reach the handler.
+func Dedup(store DedupStore) Middleware {
+	return func(next DeliveryHandler) DeliveryHandler {
+		return func(ctx context.Context, d Delivery) AckType {
+			if d.MessageID == "" {
+				return next(ctx, d)
+			}
+			seen, err := store.Seen(d.MessageID)
+			if err != nil {
+				Logger(ctx).Error("could not check message for duplicates", "error", err)
+				return NackRequeue
+			}
+			if seen {
+				Logger(ctx).Info("skipping duplicate message")
+				return Ack
+			}
+
+			ackType := next(ctx, d)
+			if ackType == NackRequeue {
+				return ackType
+			}
+			err = store.Mark(d.MessageID)
+			if err != nil {
+				Logger(ctx).Error("could not record message as handled", "error", err)
+			}
+			return ackType
+		}
+	}
+}
+
+// dedupWindow holds the most recent size IDs, forgetting the oldest first.
+type dedupWindow struct {
+	size  int
+	ids   map[string]struct{}
+	order []string
+	next  int
+}
+
+func newDedupWindow(size int) *dedupWindow {
+	if size < 1 {
+		size = 1
+	}
+	return &dedupWindow{
+		size:  size,
+		ids:   make(map[string]struct{}, size),
+		order: make([]string, 0, size),
+	}
+}
+
+func (w *dedupWindow) has(id string) bool {
+	_, ok := w.ids[id]
+	return ok
+}
+
+func (w *dedupWindow) add(id string) {
+	if w.has(id) {
+		return
+	}
+	if len(w.order) < w.size {
+		w.order = append(w.order, id)
+	} else {
+		delete(w.ids, w.order[w.next])
+		w.order[w.next] = id
+		w.next = (w.next + 1) % w.size
+	}
+	w.ids[id] = struct{}{}
+}
+
+// ordered returns the IDs in the window from oldest to newest.
+func (w *dedupWindow) ordered() []string {
+	return append(append([]string{}, w.order[w.next:]...), w.order[:w.next]...)
+}
+
+// MemoryDedupStore keeps the last size message IDs in memory.
+type MemoryDedupStore struct {
+	mu     sync.Mutex
+	window *dedupWindow
+}
+
+func NewMemoryDedupStore(size int) *MemoryDedupStore {
+	return &MemoryDedupStore{window: newDedupWindow(size)}
+}
+
+func (s *MemoryDedupStore) Seen(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.window.has(id), nil
+}
+
+func (s *MemoryDedupStore) Mark(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.window.add(id)
+	return nil
+}
+
+// FileDedupStore keeps the last size message IDs in memory and appends
+// every new one to a file, so the window survives restarts. The file is
+// rewritten with just the window once it grows to twice its size.
+//
+// Only one store can use a file at a time; NewFileDedupStore fails with
+// filelock.ErrLocked while another process has it open.
+type FileDedupStore struct {
+	mu     sync.Mutex
+	path   string
+	lock   *os.File
+	f      *os.File
+	lines  int
+	window *dedupWindow
+}
+
+func NewFileDedupStore(path string, size int) (*FileDedupStore, error) {
+	lock, err := filelock.TryLock(path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("could not lock dedup file %s: %w", path, err)
+	}
+	s, err := openFileDedupStore(path, size)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	s.lock = lock
+	return s, nil
+}
+
+func openFileDedupStore(path string, size int) (*FileDedupStore, error) {
+	s := &FileDedupStore{
+		path:   path,
+		window: newDedupWindow(size),
+	}
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not open dedup file: %w", err)
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if id := scanner.Text(); id != "" {
+				s.window.add(id)
+				s.lines++
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("could not read dedup file: %w", err)
+		}
+	}
+
+	s.f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open dedup file: %w", err)
+	}
+	return s, nil
+}
+
+func (s *FileDedupStore) Seen(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.window.has(id), nil
+}
+
+func (s *FileDedupStore) Mark(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.window.has(id) {
+		return nil
+	}
+	s.window.add(id)
+
+	_, err := fmt.Fprintln(s.f, id)
+	if err != nil {
+		return err
+	}
+	s.lines++
+	if s.lines >= 2*s.window.size {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *FileDedupStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	ids := s.window.ordered()
+	for _, id := range ids {
+		fmt.Fprintln(w, id)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return err
+	}
+
+	s.f.Close()
+	s.f, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.lines = len(ids)
+	return nil
+}
+
+func (s *FileDedupStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.f.Close()
+	s.lock.Close()
+	return err
+}
@@ -0,0 +1,45 @@
+package pubsub
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/filelock"
+)
+
+func TestFileDedupStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen")
+	s, err := NewFileDedupStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		err := s.Mark(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Another store would lose IDs marked through this one.
+	_, err = NewFileDedupStore(path, 2)
+	if !errors.Is(err, filelock.ErrLocked) {
+		t.Fatalf("opening a file in use got %v, want ErrLocked", err)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewFileDedupStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for id, want := range map[string]bool{"c": false, "d": true, "e": true} {
+		seen, _ := s.Seen(id)
+		if seen != want {
+			t.Errorf("Seen(%q) = %v after reopening, want %v", id, seen, want)
+		}
+	}
+}
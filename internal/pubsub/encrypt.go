@@ -0,0 +1,118 @@
+package pubsub
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// EncryptionKeyHeader names the key a body was encrypted with.
+const EncryptionKeyHeader = "x-encryption-key-id"
+
+const encryptionKeySize = 32
+
+var (
+	ErrUnknownEncryptionKey = errors.New("pubsub: no encryption key registered")
+	ErrDecrypt              = errors.New("pubsub: could not decrypt message")
+)
+
+var (
+	encryptionKeysMu sync.RWMutex
+	encryptionKeys   = map[string]cipher.AEAD{}
+)
+
+// NewEncryptionKey returns a random AES-256 key.
+func NewEncryptionKey() []byte {
+	key := make([]byte, encryptionKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(fmt.Sprintf("pubsub: could not generate encryption key: %v", err))
+	}
+	return key
+}
+
+// EncryptionKeyID derives a stable ID for key that can be sent in the clear.
+func EncryptionKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// RegisterEncryptionKey makes key available to WithEncryption and to
+// Subscribe for decrypting under its ID, which it returns.
+func RegisterEncryptionKey(key []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	id := EncryptionKeyID(key)
+
+	encryptionKeysMu.Lock()
+	defer encryptionKeysMu.Unlock()
+	encryptionKeys[id] = aead
+	return id, nil
+}
+
+// WithEncryption encrypts the body with AES-GCM under the registered key
+// keyID. Bodies are compressed before they are encrypted.
+func WithEncryption(keyID string) PublishOption {
+	return func(o *publishOptions) {
+		o.encryptionKeyID = keyID
+	}
+}
+
+func aeadFor(keyID string) (cipher.AEAD, error) {
+	encryptionKeysMu.RLock()
+	defer encryptionKeysMu.RUnlock()
+	aead, ok := encryptionKeys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownEncryptionKey, keyID)
+	}
+	return aead, nil
+}
+
+// encrypt seals body under keyID. The message ID is authenticated along
+// with it, so a ciphertext can't be moved to another message. The nonce is
+// prepended to the result.
+func encrypt(keyID, messageID string, body []byte) ([]byte, error) {
+	aead, err := aeadFor(keyID)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(body)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, body, []byte(messageID)), nil
+}
+
+// decrypt opens p's body if it was encrypted and returns it unchanged
+// otherwise.
+func decrypt(p Publishing) ([]byte, error) {
+	keyID, _ := p.Headers[EncryptionKeyHeader].(string)
+	if keyID == "" {
+		return p.Body, nil
+	}
+	aead, err := aeadFor(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Body) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, ciphertext := p.Body[:aead.NonceSize()], p.Body[aead.NonceSize():]
+	body, err := aead.Open(nil, nonce, ciphertext, []byte(p.MessageID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecrypt, err)
+	}
+	return body, nil
+}
@@ -0,0 +1,53 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestSubscribeRequeuesWithoutKey(t *testing.T) {
+	b := newTestBroker(t)
+	deadLetters := consumeDeadLetters(t, b)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan AckType, 1)
+	_, err := SubscribeJSON(ctx, b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", Durable, func(routing.GameLog) AckType {
+		t.Error("handled a message without its key")
+		return Ack
+	}, WithMiddleware(func(next DeliveryHandler) DeliveryHandler {
+		return func(ctx context.Context, d Delivery) AckType {
+			ackType := next(ctx, d)
+			select {
+			case results <- ackType:
+			default:
+			}
+			return ackType
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Encrypted for someone else, with a key this process never registered.
+	err = b.Publish(ctx, routing.ExchangePerilTopic, routing.GameLogSlug+".alice", Publishing{
+		Body:    []byte("sealed"),
+		Headers: Table{EncryptionKeyHeader: EncryptionKeyID(NewEncryptionKey())},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ackType := <-results:
+		if ackType != NackRequeue {
+			t.Fatalf("settled with %v, want NackRequeue", ackType)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the delivery to be settled")
+	}
+	cancel()
+	expectNone(t, deadLetters)
+}
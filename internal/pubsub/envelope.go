@@ -0,0 +1,130 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SchemaVersionHeader carries the version of the payload's schema so
+// consumers can tell old messages from new ones.
+const SchemaVersionHeader = "x-schema-version"
+
+const defaultSchemaVersion = 1
+
+var (
+	appIDMu sync.RWMutex
+	appID   string
+)
+
+// SetAppID sets the AppID stamped on every message published afterwards.
+func SetAppID(id string) {
+	appIDMu.Lock()
+	defer appIDMu.Unlock()
+	appID = id
+}
+
+func currentAppID() string {
+	appIDMu.RLock()
+	defer appIDMu.RUnlock()
+	return appID
+}
+
+// WithCorrelationID ties a message to the one that caused it.
+func WithCorrelationID(id string) PublishOption {
+	return func(o *publishOptions) {
+		o.correlationID = id
+	}
+}
+
+// WithSchemaVersion overrides the schema version header, which is 1 by
+// default.
+func WithSchemaVersion(v int) PublishOption {
+	return func(o *publishOptions) {
+		o.schemaVersion = v
+	}
+}
+
+// Message is a decoded delivery together with its envelope metadata.
+type Message[T any] struct {
+	Body          T
+	MessageID     string
+	CorrelationID string
+	AppID         string
+	Timestamp     time.Time
+	SchemaVersion int
+	Delivery      Delivery
+
+	ctx context.Context
+}
+
+// Context carries the span of the delivery being handled. Publish with it
+// to make the messages a handler sends part of the same trace.
+func (m Message[T]) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// Correlation is the ID to pass to WithCorrelationID when publishing a
+// message caused by m: m's own correlation ID if it has one, otherwise
+// its message ID.
+func (m Message[T]) Correlation() string {
+	if m.CorrelationID != "" {
+		return m.CorrelationID
+	}
+	return m.MessageID
+}
+
+// SubscribeMessage is Subscribe for handlers that need the envelope as
+// well as the payload.
+func SubscribeMessage[T any](
+	ctx context.Context,
+	sub Subscriber,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(Message[T]) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(ctx, sub, exchange, queueName, key, queueType, handler, "", opts)
+}
+
+func bodyOnly[T any](handler func(T) AckType) func(Message[T]) AckType {
+	return func(m Message[T]) AckType {
+		return handler(m.Body)
+	}
+}
+
+func newMessage[T any](ctx context.Context, d Delivery, body T) Message[T] {
+	version := int64(0)
+	if v, ok := tableInt(d.Headers, SchemaVersionHeader); ok {
+		version = v
+	}
+	return Message[T]{
+		Body:          body,
+		MessageID:     d.MessageID,
+		CorrelationID: d.CorrelationID,
+		AppID:         d.AppID,
+		Timestamp:     d.Timestamp,
+		SchemaVersion: int(version),
+		Delivery:      d,
+		ctx:           ctx,
+	}
+}
+
+// newMessageID returns a random RFC 4122 version 4 UUID.
+func newMessageID() string {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic(fmt.Sprintf("pubsub: could not generate message ID: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,67 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+)
+
+var (
+	loggerMu sync.RWMutex
+	logger   *slog.Logger
+)
+
+// SetLogger sets the logger pubsub logs to. Until it is called pubsub
+// logs to slog.Default().
+func SetLogger(l *slog.Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	logger = l
+}
+
+func currentLogger() *slog.Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+// WithLogger sets the logger a subscription logs its deliveries to instead
+// of the one set with SetLogger.
+func WithLogger(l *slog.Logger) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.logger = l
+	}
+}
+
+type loggerKey struct{}
+
+// Logger returns the logger for the delivery ctx is handling, which adds
+// the queue, routing key, delivery tag, message ID and trace ID to every
+// line. Outside a handler it returns the logger set with SetLogger.
+func Logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return currentLogger()
+}
+
+func deliveryLogger(ctx context.Context, l *slog.Logger, queueName string, d Delivery) context.Context {
+	if l == nil {
+		l = currentLogger()
+	}
+	l = l.With(
+		"queue", queueName,
+		"exchange", d.Exchange,
+		"routing_key", d.RoutingKey,
+		"delivery_tag", d.DeliveryTag,
+		"message_id", d.MessageID,
+	)
+	if sc, ok := SpanFromContext(ctx); ok {
+		l = l.With("trace_id", hex.EncodeToString(sc.TraceID[:]))
+	}
+	return context.WithValue(ctx, loggerKey{}, l)
+}
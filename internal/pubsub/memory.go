@@ -0,0 +1,542 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+const (
+	ExchangeDirect = routing.ExchangeKindDirect
+	ExchangeTopic  = routing.ExchangeKindTopic
+	ExchangeFanout = routing.ExchangeKindFanout
+)
+
+var ErrUnknownDeliveryTag = errors.New("pubsub: unknown delivery tag")
+
+// MemoryBroker is an in-process broker that mimics the parts of RabbitMQ
+// that Peril relies on: direct, topic and fanout exchanges, durable and
+// transient queues, prefetch, acks and dead-lettering. It is meant for
+// tests and local runs without a RabbitMQ container.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	nextTag   uint64
+	nextQueue int
+	nextMsg   uint64
+}
+
+type memExchange struct {
+	kind     string
+	durable  bool
+	bindings []memBinding
+}
+
+type memBinding struct {
+	queue string
+	key   string
+}
+
+type memQueue struct {
+	spec      QueueSpec
+	ready     []memMessage
+	consumers int
+}
+
+type memMessage struct {
+	id          uint64
+	exchange    string
+	routingKey  string
+	publishing  Publishing
+	redelivered bool
+}
+
+type memConsumer struct {
+	broker    *MemoryBroker
+	queue     *memQueue
+	prefetch  int
+	unacked   map[uint64]memMessage
+	cancelled bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		exchanges: map[string]*memExchange{},
+		queues:    map[string]*memQueue{},
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *MemoryBroker) DeclareExchange(ctx context.Context, name, kind string, durable bool) error {
+	switch kind {
+	case ExchangeDirect, ExchangeTopic, ExchangeFanout:
+	default:
+		return fmt.Errorf("pubsub: invalid exchange kind %q", kind)
+	}
+	if name == "" {
+		return fmt.Errorf("%w: the default exchange can not be redeclared", ErrPreconditionFailed)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.exchanges[name]; ok {
+		return b.checkExchange(name, kind, durable)
+	}
+	b.exchanges[name] = &memExchange{kind: kind, durable: durable}
+	return nil
+}
+
+func (b *MemoryBroker) BindQueue(ctx context.Context, queue, key, exchange string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrExchangeNotFound, exchange)
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrQueueNotFound, queue)
+	}
+	b.bind(ex, q, key)
+	return nil
+}
+
+func (b *MemoryBroker) CheckExchange(ctx context.Context, name, kind string, durable bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.checkExchange(name, kind, durable)
+}
+
+func (b *MemoryBroker) CheckQueue(ctx context.Context, spec QueueSpec) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[spec.Name]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrQueueNotFound, spec.Name)
+	}
+	if !reflect.DeepEqual(q.spec, spec) {
+		return fmt.Errorf("%w: queue %q was declared with different arguments", ErrPreconditionFailed, spec.Name)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) CheckBinding(ctx context.Context, queue, key, exchange string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrExchangeNotFound, exchange)
+	}
+	for _, binding := range ex.bindings {
+		if binding.queue == queue && binding.key == key {
+			return nil
+		}
+	}
+	return ErrBindingNotFound
+}
+
+// checkExchange must be called with b.mu held.
+func (b *MemoryBroker) checkExchange(name, kind string, durable bool) error {
+	ex, ok := b.exchanges[name]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrExchangeNotFound, name)
+	}
+	if ex.kind != kind || ex.durable != durable {
+		return fmt.Errorf("%w: exchange %q was declared with different arguments", ErrPreconditionFailed, name)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if exchange != "" {
+		if _, ok := b.exchanges[exchange]; !ok {
+			return fmt.Errorf("%w: %q", ErrExchangeNotFound, exchange)
+		}
+	}
+	b.route(memMessage{
+		exchange:   exchange,
+		routingKey: key,
+		publishing: msg,
+	})
+	b.cond.Broadcast()
+	return nil
+}
+
+// PublishConfirmed is the same as Publish: messages are routed to their
+// queues before Publish returns, so there is nothing further to wait for.
+func (b *MemoryBroker) PublishConfirmed(ctx context.Context, exchange, key string, msg Publishing) error {
+	return b.Publish(ctx, exchange, key, msg)
+}
+
+func (b *MemoryBroker) Consume(
+	ctx context.Context,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	prefetch int,
+) (<-chan Delivery, error) {
+	return b.ConsumeQueue(ctx, simpleQueueSpec(queueName, queueType), exchange, key, prefetch)
+}
+
+func (b *MemoryBroker) ConsumeQueue(ctx context.Context, spec QueueSpec, exchange, key string, prefetch int) (<-chan Delivery, error) {
+	b.mu.Lock()
+	q, err := b.declareAndBind(exchange, spec, key)
+	if err != nil {
+		b.mu.Unlock()
+		return nil, err
+	}
+	q.consumers++
+	b.mu.Unlock()
+
+	c := &memConsumer{
+		broker:   b,
+		queue:    q,
+		prefetch: prefetch,
+		unacked:  map[uint64]memMessage{},
+	}
+	out := make(chan Delivery)
+	go c.run(ctx, out)
+	return out, nil
+}
+
+func (b *MemoryBroker) DeclareQueue(ctx context.Context, spec QueueSpec) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.declareQueue(spec)
+	return err
+}
+
+// declareQueue must be called with b.mu held.
+func (b *MemoryBroker) declareQueue(spec QueueSpec) (*memQueue, error) {
+	if spec.Name == "" {
+		b.nextQueue++
+		spec.Name = fmt.Sprintf("amq.gen-%d", b.nextQueue)
+	}
+	q, ok := b.queues[spec.Name]
+	if ok {
+		// An exclusive queue belongs to the consumer that declared it, as
+		// it belongs to one connection in RabbitMQ.
+		if q.spec.Exclusive && q.consumers > 0 {
+			return nil, fmt.Errorf("%w: queue %q is exclusive to another consumer", ErrResourceLocked, spec.Name)
+		}
+		if !reflect.DeepEqual(q.spec, spec) {
+			return nil, fmt.Errorf("%w: queue %q was declared with different arguments", ErrPreconditionFailed, spec.Name)
+		}
+		return q, nil
+	}
+	q = &memQueue{spec: spec}
+	b.queues[spec.Name] = q
+	return q, nil
+}
+
+// declareAndBind must be called with b.mu held.
+func (b *MemoryBroker) declareAndBind(exchange string, spec QueueSpec, key string) (*memQueue, error) {
+	ex, ok := b.exchanges[exchange]
+	if !ok && exchange != "" {
+		return nil, fmt.Errorf("%w: %q", ErrExchangeNotFound, exchange)
+	}
+
+	q, err := b.declareQueue(spec)
+	if err != nil {
+		return nil, err
+	}
+	if ex != nil {
+		b.bind(ex, q, key)
+	}
+	return q, nil
+}
+
+// bind must be called with b.mu held.
+func (b *MemoryBroker) bind(ex *memExchange, q *memQueue, key string) {
+	for _, binding := range ex.bindings {
+		if binding.queue == q.spec.Name && binding.key == key {
+			return
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{queue: q.spec.Name, key: key})
+}
+
+// route must be called with b.mu held.
+func (b *MemoryBroker) route(m memMessage) {
+	if m.exchange == "" {
+		if q, ok := b.queues[m.routingKey]; ok {
+			b.enqueue(q, m)
+		}
+		return
+	}
+
+	ex, ok := b.exchanges[m.exchange]
+	if !ok {
+		return
+	}
+	matched := map[string]struct{}{}
+	for _, binding := range ex.bindings {
+		if _, ok := matched[binding.queue]; ok {
+			continue
+		}
+		if !bindingMatches(ex.kind, binding.key, m.routingKey) {
+			continue
+		}
+		q, ok := b.queues[binding.queue]
+		if !ok {
+			continue
+		}
+		matched[binding.queue] = struct{}{}
+		b.enqueue(q, m)
+	}
+}
+
+// deadLetter must be called with b.mu held.
+func (b *MemoryBroker) deadLetter(q *memQueue, m memMessage, reason string) {
+	dlx, ok := q.spec.Args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := m.routingKey
+	if dlKey, ok := q.spec.Args["x-dead-letter-routing-key"].(string); ok {
+		key = dlKey
+	}
+
+	headers := cloneTable(m.publishing.Headers)
+	headers["x-death"] = appendDeath(headers["x-death"], Table{
+		"count":        int64(1),
+		"reason":       reason,
+		"queue":        q.spec.Name,
+		"time":         time.Now(),
+		"exchange":     m.exchange,
+		"routing-keys": []any{m.routingKey},
+	})
+
+	pub := m.publishing
+	pub.Headers = headers
+	b.route(memMessage{
+		exchange:   dlx,
+		routingKey: key,
+		publishing: pub,
+	})
+}
+
+// enqueue must be called with b.mu held.
+func (b *MemoryBroker) enqueue(q *memQueue, m memMessage) {
+	b.nextMsg++
+	m.id = b.nextMsg
+	m.publishing.Headers = cloneTable(m.publishing.Headers)
+	m.redelivered = false
+	q.ready = append(q.ready, m)
+
+	ttl, ok := tableInt(q.spec.Args, "x-message-ttl")
+	if !ok {
+		return
+	}
+	time.AfterFunc(time.Duration(ttl)*time.Millisecond, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.queues[q.spec.Name] != q {
+			return
+		}
+		for i, ready := range q.ready {
+			if ready.id == m.id {
+				q.ready = append(q.ready[:i], q.ready[i+1:]...)
+				b.deadLetter(q, ready, "expired")
+				b.cond.Broadcast()
+				return
+			}
+		}
+	})
+}
+
+func (c *memConsumer) run(ctx context.Context, out chan<- Delivery) {
+	b := c.broker
+	stop := context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		c.cancelled = true
+		b.cond.Broadcast()
+	})
+	defer stop()
+	defer close(out)
+
+	for {
+		b.mu.Lock()
+		for !c.cancelled && (len(c.queue.ready) == 0 || (c.prefetch > 0 && len(c.unacked) >= c.prefetch)) {
+			b.cond.Wait()
+		}
+		if c.cancelled {
+			c.release()
+			b.mu.Unlock()
+			return
+		}
+		m := c.queue.ready[0]
+		c.queue.ready = c.queue.ready[1:]
+		b.nextTag++
+		tag := b.nextTag
+		c.unacked[tag] = m
+		b.mu.Unlock()
+
+		d := Delivery{
+			Publishing:   m.publishing,
+			Exchange:     m.exchange,
+			RoutingKey:   m.routingKey,
+			DeliveryTag:  tag,
+			Redelivered:  m.redelivered,
+			Acknowledger: c,
+		}
+		select {
+		case out <- d:
+		case <-ctx.Done():
+			b.mu.Lock()
+			c.cancelled = true
+			c.requeue(tag)
+			c.release()
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (c *memConsumer) Ack(tag uint64) error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := c.unacked[tag]; !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownDeliveryTag, tag)
+	}
+	delete(c.unacked, tag)
+	c.release()
+	b.cond.Broadcast()
+	return nil
+}
+
+func (c *memConsumer) Nack(tag uint64, requeue bool) error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, ok := c.unacked[tag]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownDeliveryTag, tag)
+	}
+	if requeue {
+		c.requeue(tag)
+	} else {
+		delete(c.unacked, tag)
+		b.deadLetter(c.queue, m, "rejected")
+	}
+	c.release()
+	b.cond.Broadcast()
+	return nil
+}
+
+// requeue must be called with b.mu held.
+func (c *memConsumer) requeue(tag uint64) {
+	m, ok := c.unacked[tag]
+	if !ok {
+		return
+	}
+	delete(c.unacked, tag)
+	m.redelivered = true
+	c.queue.ready = append([]memMessage{m}, c.queue.ready...)
+	c.broker.cond.Broadcast()
+}
+
+// release detaches a cancelled consumer from its queue once every
+// delivery it handed out has been settled, deleting transient queues
+// that are left without consumers. It must be called with b.mu held.
+func (c *memConsumer) release() {
+	if !c.cancelled || len(c.unacked) > 0 || c.queue == nil {
+		return
+	}
+	q := c.queue
+	c.queue = nil
+	q.consumers--
+	if !q.spec.AutoDelete || q.consumers > 0 {
+		return
+	}
+
+	b := c.broker
+	delete(b.queues, q.spec.Name)
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, binding := range ex.bindings {
+			if binding.queue != q.spec.Name {
+				bindings = append(bindings, binding)
+			}
+		}
+		ex.bindings = bindings
+	}
+}
+
+func bindingMatches(kind, pattern, key string) bool {
+	switch kind {
+	case ExchangeFanout:
+		return true
+	case ExchangeTopic:
+		return topicMatches(strings.Split(pattern, "."), strings.Split(key, "."))
+	default:
+		return pattern == key
+	}
+}
+
+// topicMatches implements AMQP topic matching where "*" matches exactly
+// one word and "#" matches zero or more words.
+func topicMatches(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatches(pattern[1:], words[1:])
+	}
+}
+
+// appendDeath records a dead-lettering event the way RabbitMQ does: the
+// most recent event comes first and repeated events for the same queue
+// and reason bump the count of the existing entry.
+func appendDeath(existing any, death Table) []any {
+	deaths, _ := existing.([]any)
+	out := []any{death}
+	for _, d := range deaths {
+		entry, ok := d.(Table)
+		if !ok {
+			continue
+		}
+		if entry["queue"] == death["queue"] && entry["reason"] == death["reason"] {
+			count, _ := entry["count"].(int64)
+			death["count"] = count + 1
+			continue
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+func cloneTable(t Table) Table {
+	out := Table{}
+	for k, v := range t {
+		out[k] = v
+	}
+	return out
+}
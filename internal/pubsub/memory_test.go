@@ -0,0 +1,234 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"army_moves.*", "army_moves.alice", true},
+		{"army_moves.*", "army_moves", false},
+		{"army_moves.*", "army_moves.alice.bob", false},
+		{"*.alice", "army_moves.alice", true},
+		{"*", "", true},
+		{"#", "army_moves.alice", true},
+		{"#", "", true},
+		{"army_moves.#", "army_moves", true},
+		{"army_moves.#", "army_moves.alice.bob", true},
+		{"army_moves.#", "war.alice", false},
+		{"a.#.z", "a.z", true},
+		{"a.#.z", "a.b.c.z", true},
+		{"a.#.z", "a.b.c", false},
+		{"a.#.*", "a", false},
+		{"a.#.*", "a.b", true},
+		{"pause", "", false},
+		{"", "", true},
+		{"", "pause", false},
+	}
+	for _, tt := range tests {
+		got := topicMatches(strings.Split(tt.pattern, "."), strings.Split(tt.key, "."))
+		if got != tt.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func newTestBroker(t *testing.T) *MemoryBroker {
+	t.Helper()
+	b := NewMemoryBroker()
+	err := ApplyTopology(context.Background(), b, routing.PerilTopology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func receive(t *testing.T, deliveries <-chan Delivery) Delivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a delivery")
+	}
+	return Delivery{}
+}
+
+func expectNone(t *testing.T, deliveries <-chan Delivery) {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		t.Fatalf("unexpected delivery with routing key %q", d.RoutingKey)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// consumeGameLogs consumes the durable game_logs queue one delivery at a
+// time until the test ends or cancel is called.
+func consumeGameLogs(t *testing.T, b *MemoryBroker) (<-chan Delivery, context.CancelFunc) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	deliveries, err := b.Consume(ctx, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", Durable, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries, cancel
+}
+
+func consumeDeadLetters(t *testing.T, b *MemoryBroker) <-chan Delivery {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	deliveries, err := b.ConsumeQueue(ctx, QueueSpec{Name: routing.DeadLetterQueue, Durable: true}, routing.ExchangePerilDLX, "#", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+func publishGameLog(t *testing.T, b *MemoryBroker, body string) {
+	t.Helper()
+	err := b.Publish(context.Background(), routing.ExchangePerilTopic, routing.GameLogSlug+".alice", Publishing{Body: []byte(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryBrokerAck(t *testing.T) {
+	b := newTestBroker(t)
+	deliveries, cancel := consumeGameLogs(t, b)
+	publishGameLog(t, b, "hello")
+
+	d := receive(t, deliveries)
+	if string(d.Body) != "hello" || d.RoutingKey != "game_logs.alice" {
+		t.Fatalf("got %q with routing key %q", d.Body, d.RoutingKey)
+	}
+	err := d.Ack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ack(); err == nil {
+		t.Fatal("acking twice succeeded")
+	}
+
+	// An acked message is gone for good, even for the next consumer.
+	cancel()
+	deliveries, _ = consumeGameLogs(t, b)
+	expectNone(t, deliveries)
+}
+
+func TestMemoryBrokerRequeue(t *testing.T) {
+	b := newTestBroker(t)
+	deliveries, _ := consumeGameLogs(t, b)
+	publishGameLog(t, b, "first")
+	publishGameLog(t, b, "second")
+
+	d := receive(t, deliveries)
+	if d.Redelivered {
+		t.Fatal("first delivery is marked redelivered")
+	}
+	err := d.Nack(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requeued messages go back to the front of the queue.
+	d = receive(t, deliveries)
+	if string(d.Body) != "first" || !d.Redelivered {
+		t.Fatalf("got %q, redelivered %v; want a redelivery of %q", d.Body, d.Redelivered, "first")
+	}
+	d.Ack()
+	d = receive(t, deliveries)
+	if string(d.Body) != "second" || d.Redelivered {
+		t.Fatalf("got %q, redelivered %v; want %q", d.Body, d.Redelivered, "second")
+	}
+	d.Ack()
+}
+
+func TestMemoryBrokerDiscard(t *testing.T) {
+	b := newTestBroker(t)
+	deliveries, _ := consumeGameLogs(t, b)
+	deadLetters := consumeDeadLetters(t, b)
+	publishGameLog(t, b, "hello")
+
+	d := receive(t, deliveries)
+	err := d.Nack(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNone(t, deliveries)
+
+	dl := receive(t, deadLetters)
+	if string(dl.Body) != "hello" || dl.Exchange != routing.ExchangePerilDLX || dl.RoutingKey != "game_logs.alice" {
+		t.Fatalf("got %q from %q with routing key %q", dl.Body, dl.Exchange, dl.RoutingKey)
+	}
+	deaths, _ := dl.Headers["x-death"].([]any)
+	if len(deaths) != 1 {
+		t.Fatalf("got %d x-death entries, want 1", len(deaths))
+	}
+	death := deaths[0].(Table)
+	if death["queue"] != routing.GameLogSlug || death["reason"] != "rejected" || death["exchange"] != routing.ExchangePerilTopic {
+		t.Fatalf("got x-death %v", death)
+	}
+
+	// The dead-letter queue has no dead-letter exchange, so discarding a
+	// dead letter drops it rather than routing it back.
+	err = dl.Nack(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNone(t, deadLetters)
+}
+
+func TestMemoryBrokerTransientQueue(t *testing.T) {
+	b := newTestBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := b.Consume(ctx, routing.ExchangePerilTopic, "pause.alice", routing.PauseKey, Transient, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	// Transient queues are deleted once their last consumer goes away.
+	deadline := time.Now().Add(time.Second)
+	for b.CheckQueue(context.Background(), simpleQueueSpec("pause.alice", Transient)) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("transient queue outlived its consumer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMemoryBrokerExclusiveQueue(t *testing.T) {
+	b := newTestBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := b.Consume(ctx, routing.ExchangePerilTopic, "pause.alice", routing.PauseKey, Transient, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Consume(ctx, routing.ExchangePerilTopic, "pause.alice", routing.PauseKey, Transient, 0)
+	if !errors.Is(err, ErrResourceLocked) {
+		t.Fatalf("second consumer of an exclusive queue got %v, want ErrResourceLocked", err)
+	}
+
+	// Shared queues take any number of consumers.
+	for range 2 {
+		_, err = b.Consume(ctx, routing.ExchangePerilDirect, "rpc.echo", "rpc.echo", Shared, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package pubsub
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics recorded for every publish and delivery. They are labelled with
+// the routing key's prefix rather than the whole key: most Peril keys end
+// in a player or an RPC reply queue, so there would be no end to the
+// series.
+var (
+	publishedTotal = NewCounter("peril_pubsub_published_total",
+		"Messages published.", "exchange", "routing_key")
+	publishFailuresTotal = NewCounter("peril_pubsub_publish_failures_total",
+		"Messages that could not be published.", "exchange", "routing_key")
+	consumedTotal = NewCounter("peril_pubsub_consumed_total",
+		"Deliveries received by subscriptions.", "queue", "exchange", "routing_key")
+	settledTotal = NewCounter("peril_pubsub_settled_total",
+		"Deliveries settled, by outcome: ack, requeue or discard.", "queue", "exchange", "routing_key", "outcome")
+	decodeFailuresTotal = NewCounter("peril_pubsub_decode_failures_total",
+		"Deliveries whose body could not be decoded.", "queue", "exchange", "routing_key")
+	handlerSeconds = NewHistogram("peril_pubsub_handler_duration_seconds",
+		"Time taken to handle a delivery, including middleware.",
+		[]float64{.001, .005, .01, .05, .1, .5, 1, 2.5, 5, 10}, "queue", "exchange", "routing_key")
+)
+
+func recordPublish(exchange, key string, err error) {
+	if err != nil {
+		publishFailuresTotal.Inc(exchange, routingKeyLabel(key))
+		return
+	}
+	publishedTotal.Inc(exchange, routingKeyLabel(key))
+}
+
+// routingKeyLabel is the first word of key, such as army_moves, war,
+// game_logs or rpc.
+func routingKeyLabel(key string) string {
+	prefix, _, _ := strings.Cut(key, ".")
+	return prefix
+}
+
+func outcomeLabel(ackType AckType) string {
+	switch ackType {
+	case Ack:
+		return "ack"
+	case NackRequeue:
+		return "requeue"
+	case NackDiscard:
+		return "discard"
+	}
+	return "unknown"
+}
+
+type metric interface {
+	writeTo(w *bufio.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []metric
+)
+
+func register(m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics = append(metrics, m)
+}
+
+// WriteMetrics writes every metric in the Prometheus text exposition
+// format.
+func WriteMetrics(w io.Writer) error {
+	metricsMu.Lock()
+	ms := append([]metric{}, metrics...)
+	metricsMu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range ms {
+		m.writeTo(bw)
+	}
+	return bw.Flush()
+}
+
+// MetricsHandler serves WriteMetrics over HTTP.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteMetrics(w)
+	})
+}
+
+// family holds the series of one metric, keyed by their label values.
+type family[S any] struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*S
+	values map[string][]string
+}
+
+func newFamily[S any](name, help string, labels []string) family[S] {
+	return family[S]{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: map[string]*S{},
+		values: map[string][]string{},
+	}
+}
+
+// get must be called with f.mu held.
+func (f *family[S]) get(values []string, init func() *S) *S {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("pubsub: metric %s has %d labels, got %d values", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = init()
+		f.series[key] = s
+		f.values[key] = append([]string{}, values...)
+	}
+	return s
+}
+
+// sortedKeys must be called with f.mu held.
+func (f *family[S]) sortedKeys() []string {
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *family[S]) writeHeader(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, kind)
+}
+
+// Counter is a Prometheus counter with one series per combination of
+// label values.
+type Counter struct {
+	family[float64]
+}
+
+// NewCounter registers a counter that WriteMetrics will report. It's meant
+// to be called when a package is initialised, like expvar.NewInt.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newFamily[float64](name, help, labels)}
+	register(c)
+	return c
+}
+
+// Inc adds one to the series with the given label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *Counter) Add(n float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.get(values, func() *float64 { return new(float64) }) += n
+}
+
+func (c *Counter) writeTo(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w, "counter")
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelPairs(c.labels, c.values[key]), formatFloat(*c.series[key]))
+	}
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram is a Prometheus histogram with one series per combination of
+// label values.
+type Histogram struct {
+	family[histogramSeries]
+	buckets []float64
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds,
+// which must be sorted. The +Inf bucket is added automatically.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{newFamily[histogramSeries](name, help, labels), buckets}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.get(values, func() *histogramSeries {
+		return &histogramSeries{counts: make([]uint64, len(h.buckets))}
+	})
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// ObserveDuration observes d in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration, values ...string) {
+	h.Observe(d.Seconds(), values...)
+}
+
+func (h *Histogram) writeTo(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w, "histogram")
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range h.sortedKeys() {
+		s := h.series[key]
+		values := h.values[key]
+		values = values[:len(values):len(values)]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(labels, append(values, formatFloat(le))), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(labels, append(values, "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, values), s.count)
+	}
+}
+
+func labelPairs(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,38 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestMetricsRoutingKeyLabel(t *testing.T) {
+	b := newTestBroker(t)
+	for _, key := range []string{routing.GameLogSlug + ".alice", routing.PauseStateRPC} {
+		err := publish(context.Background(), b, routing.ExchangePerilTopic, key, Publishing{Body: []byte("{}")}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := WriteMetrics(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := buf.String()
+	for _, want := range []string{
+		`peril_pubsub_published_total{exchange="peril_topic",routing_key="game_logs"}`,
+		`peril_pubsub_published_total{exchange="peril_topic",routing_key="rpc"}`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics are missing %s", want)
+		}
+	}
+	if strings.Contains(metrics, "alice") {
+		t.Error("metrics are labelled with a player")
+	}
+}
@@ -0,0 +1,80 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DeliveryHandler handles one delivery and says how it should be settled.
+type DeliveryHandler func(ctx context.Context, d Delivery) AckType
+
+// Middleware wraps a DeliveryHandler. It sees every delivery before it is
+// decoded and the AckType the handler chose for it.
+type Middleware func(next DeliveryHandler) DeliveryHandler
+
+var (
+	middlewareMu     sync.RWMutex
+	globalMiddleware []Middleware
+)
+
+// Use adds middleware to every subscription made after the call. Global
+// middleware runs before middleware passed with WithMiddleware.
+func Use(mw ...Middleware) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	globalMiddleware = append(globalMiddleware, mw...)
+}
+
+// WithMiddleware adds middleware to a single subscription. The first
+// middleware is the outermost.
+func WithMiddleware(mw ...Middleware) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.middleware = append(o.middleware, mw...)
+	}
+}
+
+func chain(handler DeliveryHandler, local []Middleware) DeliveryHandler {
+	middlewareMu.RLock()
+	mw := append(append([]Middleware{}, globalMiddleware...), local...)
+	middlewareMu.RUnlock()
+
+	for i := len(mw) - 1; i >= 0; i-- {
+		handler = mw[i](handler)
+	}
+	return handler
+}
+
+// Logging logs how every delivery was settled, with the delivery's
+// fields and an outcome of ack, requeue or discard.
+func Logging() Middleware {
+	return func(next DeliveryHandler) DeliveryHandler {
+		return func(ctx context.Context, d Delivery) AckType {
+			ackType := next(ctx, d)
+			Logger(ctx).Info("settled delivery", "outcome", outcomeLabel(ackType))
+			return ackType
+		}
+	}
+}
+
+// Timing reports how long each delivery took to handle.
+func Timing(report func(d Delivery, ackType AckType, elapsed time.Duration)) Middleware {
+	return func(next DeliveryHandler) DeliveryHandler {
+		return func(ctx context.Context, d Delivery) AckType {
+			start := time.Now()
+			ackType := next(ctx, d)
+			report(d, ackType, time.Since(start))
+			return ackType
+		}
+	}
+}
+
+// Finally runs fn after every delivery, whatever the outcome.
+func Finally(fn func()) Middleware {
+	return func(next DeliveryHandler) DeliveryHandler {
+		return func(ctx context.Context, d Delivery) AckType {
+			defer fn()
+			return next(ctx, d)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var errPending = errors.New("pubsub: outbox has messages waiting")
+
+func init() {
+	gob.Register(Table{})
+	gob.Register([]any{})
+	gob.Register(time.Time{})
+}
+
+type outboxEntry struct {
+	Exchange string
+	Key      string
+	Msg      Publishing
+	Confirm  bool
+}
+
+// Outbox is a Publisher that never loses a message to a broker outage.
+// Messages that can't be published for want of a connection are appended
+// to a file and published, in order, by Flush. While anything is waiting
+// in the outbox new messages queue behind it, so the broker sees them in
+// the order they were sent. Other errors are returned as usual, since
+// retrying wouldn't fix them.
+//
+// A crash during Flush can publish a message twice; consumers that care
+// should de-duplicate by message ID.
+type Outbox struct {
+	pub  Publisher
+	path string
+
+	mu      sync.Mutex
+	f       *os.File
+	pending []outboxEntry
+}
+
+// NewOutbox opens the outbox at path, loading any messages left unsent by
+// a previous run. Call Flush to send them.
+func NewOutbox(pub Publisher, path string) (*Outbox, error) {
+	o := &Outbox{pub: pub, path: path}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read outbox: %w", err)
+	}
+	var n int
+	o.pending, n, err = readOutbox(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not read outbox: %w", err)
+	}
+	if n < len(data) {
+		// A crash while appending leaves a partial record at the end.
+		currentLogger().Warn("dropping truncated outbox entry", "path", path, "bytes", len(data)-n)
+		err = os.Truncate(path, int64(n))
+		if err != nil {
+			return nil, fmt.Errorf("could not repair outbox: %w", err)
+		}
+	}
+	o.f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open outbox: %w", err)
+	}
+	return o, nil
+}
+
+func (o *Outbox) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+	return o.send(ctx, outboxEntry{Exchange: exchange, Key: key, Msg: msg})
+}
+
+// PublishConfirmed waits for the broker's confirm if the message can be
+// published now. Otherwise it returns once the message is in the outbox.
+func (o *Outbox) PublishConfirmed(ctx context.Context, exchange, key string, msg Publishing) error {
+	return o.send(ctx, outboxEntry{Exchange: exchange, Key: key, Msg: msg, Confirm: true})
+}
+
+// PublishBatch publishes msgs as one batch if nothing is waiting in the
+// outbox, then keeps the messages that failed. Messages of a batch are
+// independent, so those kept can end up behind later ones of the batch.
+// If the wrapped publisher can't publish batches, the messages are sent
+// one at a time as by Publish.
+func (o *Outbox) PublishBatch(ctx context.Context, exchange, key string, msgs []Publishing, confirm bool) []error {
+	errs := make([]error, len(msgs))
+	bp, ok := o.pub.(BatchPublisher)
+	if !ok {
+		for i, msg := range msgs {
+			errs[i] = o.send(ctx, outboxEntry{Exchange: exchange, Key: key, Msg: msg, Confirm: confirm})
+		}
+		return errs
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) == 0 {
+		errs = bp.PublishBatch(ctx, exchange, key, msgs, confirm)
+	} else {
+		for i := range errs {
+			errs[i] = errPending
+		}
+	}
+	kept := 0
+	for i, err := range errs {
+		if err == nil || !retryable(err) {
+			continue
+		}
+		e := outboxEntry{Exchange: exchange, Key: key, Msg: msgs[i], Confirm: confirm}
+		errs[i] = o.append(e)
+		if errs[i] == nil {
+			o.pending = append(o.pending, e)
+			kept++
+		}
+	}
+	if kept > 0 {
+		currentLogger().Warn("could not publish, keeping messages in the outbox", "exchange", exchange, "routing_key", key, "kept", kept)
+	}
+	return errs
+}
+
+// Pending returns how many messages are waiting in the outbox.
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Flush publishes waiting messages in order, stopping at the first one
+// that fails for want of a connection. Messages that fail for any other
+// reason are logged and dropped, so they can't hold up the rest.
+func (o *Outbox) Flush(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) == 0 {
+		return nil
+	}
+
+	done, dropped := 0, 0
+	var err error
+	for _, e := range o.pending {
+		err = o.publish(ctx, e)
+		if err != nil && retryable(err) {
+			break
+		}
+		if err != nil {
+			currentLogger().Error("dropping message from the outbox", "exchange", e.Exchange, "routing_key", e.Key, "message_id", e.Msg.MessageID, "error", err)
+			dropped++
+			err = nil
+		}
+		done++
+	}
+	o.pending = o.pending[done:]
+	if done > 0 {
+		currentLogger().Info("flushed outbox", "sent", done-dropped, "dropped", dropped, "pending", len(o.pending))
+		if rerr := o.rewrite(); rerr != nil {
+			return rerr
+		}
+	}
+	return err
+}
+
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.f.Close()
+}
+
+func (o *Outbox) send(ctx context.Context, e outboxEntry) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) == 0 {
+		err := o.publish(ctx, e)
+		if err == nil || !retryable(err) {
+			return err
+		}
+		currentLogger().Warn("could not publish, keeping message in the outbox", "exchange", e.Exchange, "routing_key", e.Key, "error", err)
+	}
+	err := o.append(e)
+	if err != nil {
+		return err
+	}
+	o.pending = append(o.pending, e)
+	return nil
+}
+
+func (o *Outbox) publish(ctx context.Context, e outboxEntry) error {
+	if !e.Confirm {
+		return o.pub.Publish(ctx, e.Exchange, e.Key, e.Msg)
+	}
+	confirmer, ok := o.pub.(Confirmer)
+	if !ok {
+		return ErrConfirmsUnsupported
+	}
+	ctx, cancel := withConfirmTimeout(ctx)
+	defer cancel()
+	return confirmer.PublishConfirmed(ctx, e.Exchange, e.Key, e.Msg)
+}
+
+// retryable reports whether err means the broker couldn't be reached, as
+// opposed to it or the publisher refusing the message. A confirm that
+// timed out may still arrive, so the message is kept and can be published
+// twice.
+func retryable(err error) bool {
+	return errors.Is(err, errPending) ||
+		errors.Is(err, ErrNotConnected) ||
+		errors.Is(err, ErrManagerClosed) ||
+		errors.Is(err, amqp.ErrClosed) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// append must be called with o.mu held. Entries are stored as a length
+// followed by a gob-encoded outboxEntry.
+func (o *Outbox) append(e outboxEntry) error {
+	record, err := encodeOutboxEntry(e)
+	if err != nil {
+		return err
+	}
+	_, err = o.f.Write(record)
+	if err != nil {
+		return fmt.Errorf("could not write to outbox: %w", err)
+	}
+	return o.f.Sync()
+}
+
+// rewrite must be called with o.mu held.
+func (o *Outbox) rewrite() error {
+	var buf bytes.Buffer
+	for _, e := range o.pending {
+		record, err := encodeOutboxEntry(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(record)
+	}
+	tmp := o.path + ".tmp"
+	err := os.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("could not rewrite outbox: %w", err)
+	}
+	err = os.Rename(tmp, o.path)
+	if err != nil {
+		return fmt.Errorf("could not rewrite outbox: %w", err)
+	}
+	f, err := os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open outbox: %w", err)
+	}
+	o.f.Close()
+	o.f = f
+	return nil
+}
+
+func encodeOutboxEntry(e outboxEntry) ([]byte, error) {
+	var body bytes.Buffer
+	err := gob.NewEncoder(&body).Encode(e)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode outbox entry: %w", err)
+	}
+	record := binary.BigEndian.AppendUint32(nil, uint32(body.Len()))
+	return append(record, body.Bytes()...), nil
+}
+
+// readOutbox returns the complete entries in data and how many bytes
+// they take up.
+func readOutbox(data []byte) ([]outboxEntry, int, error) {
+	entries := []outboxEntry{}
+	n := 0
+	for len(data)-n >= 4 {
+		size := int(binary.BigEndian.Uint32(data[n:]))
+		if len(data)-n-4 < size {
+			break
+		}
+		var e outboxEntry
+		err := gob.NewDecoder(bytes.NewReader(data[n+4 : n+4+size])).Decode(&e)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+		n += 4 + size
+	}
+	return entries, n, nil
+}
@@ -0,0 +1,234 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// gatedPublisher publishes to a MemoryBroker unless fail returns an error
+// for the message.
+type gatedPublisher struct {
+	b    *MemoryBroker
+	mu   sync.Mutex
+	fail func(msg Publishing) error
+}
+
+func (p *gatedPublisher) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+	p.mu.Lock()
+	fail := p.fail
+	p.mu.Unlock()
+	if fail != nil {
+		if err := fail(msg); err != nil {
+			return err
+		}
+	}
+	return p.b.Publish(ctx, exchange, key, msg)
+}
+
+func (p *gatedPublisher) setFail(fail func(msg Publishing) error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fail = fail
+}
+
+func disconnected(Publishing) error {
+	return ErrNotConnected
+}
+
+func openTestOutbox(t *testing.T, pub Publisher, path string) *Outbox {
+	t.Helper()
+	o, err := NewOutbox(pub, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { o.Close() })
+	return o
+}
+
+func publishToOutbox(t *testing.T, o *Outbox, bodies ...string) {
+	t.Helper()
+	for _, body := range bodies {
+		err := o.Publish(context.Background(), routing.ExchangePerilTopic, routing.GameLogSlug+".alice", Publishing{Body: []byte(body)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectBodies(t *testing.T, deliveries <-chan Delivery, bodies ...string) {
+	t.Helper()
+	for _, body := range bodies {
+		d := receive(t, deliveries)
+		if string(d.Body) != body {
+			t.Fatalf("got %q, want %q", d.Body, body)
+		}
+		d.Ack()
+	}
+	expectNone(t, deliveries)
+}
+
+func TestOutboxFlushesInOrder(t *testing.T) {
+	b := newTestBroker(t)
+	deliveries, _ := consumeGameLogs(t, b)
+	pub := &gatedPublisher{b: b, fail: disconnected}
+	o := openTestOutbox(t, pub, filepath.Join(t.TempDir(), "alice.outbox"))
+
+	publishToOutbox(t, o, "1", "2")
+	pub.setFail(nil)
+	// Messages queue behind those already waiting, even once the broker
+	// is back.
+	publishToOutbox(t, o, "3")
+	if n := o.Pending(); n != 3 {
+		t.Fatalf("got %d pending, want 3", n)
+	}
+	expectNone(t, deliveries)
+
+	err := o.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := o.Pending(); n != 0 {
+		t.Fatalf("got %d pending after flush, want 0", n)
+	}
+	expectBodies(t, deliveries, "1", "2", "3")
+
+	publishToOutbox(t, o, "4")
+	expectBodies(t, deliveries, "4")
+}
+
+func TestOutboxFlushStopsAtConnectionError(t *testing.T) {
+	b := newTestBroker(t)
+	deliveries, _ := consumeGameLogs(t, b)
+	pub := &gatedPublisher{b: b, fail: disconnected}
+	o := openTestOutbox(t, pub, filepath.Join(t.TempDir(), "alice.outbox"))
+	publishToOutbox(t, o, "1", "2", "3")
+
+	pub.setFail(func(msg Publishing) error {
+		if string(msg.Body) == "2" {
+			return ErrNotConnected
+		}
+		return nil
+	})
+	err := o.Flush(context.Background())
+	if !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("got %v, want ErrNotConnected", err)
+	}
+	if n := o.Pending(); n != 2 {
+		t.Fatalf("got %d pending, want 2", n)
+	}
+	expectBodies(t, deliveries, "1")
+
+	pub.setFail(nil)
+	err = o.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBodies(t, deliveries, "2", "3")
+}
+
+func TestOutboxDropsPermanentFailures(t *testing.T) {
+	b := newTestBroker(t)
+	deliveries, _ := consumeGameLogs(t, b)
+	pub := &gatedPublisher{b: b, fail: disconnected}
+	o := openTestOutbox(t, pub, filepath.Join(t.TempDir(), "alice.outbox"))
+	publishToOutbox(t, o, "1", "bad", "3")
+
+	refused := errors.New("refused")
+	pub.setFail(func(msg Publishing) error {
+		if string(msg.Body) == "bad" {
+			return refused
+		}
+		return nil
+	})
+	err := o.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := o.Pending(); n != 0 {
+		t.Fatalf("got %d pending, want 0", n)
+	}
+	expectBodies(t, deliveries, "1", "3")
+
+	// Errors other than losing the connection are returned, not kept.
+	err = o.Publish(context.Background(), routing.ExchangePerilTopic, routing.GameLogSlug+".alice", Publishing{Body: []byte("bad")})
+	if !errors.Is(err, refused) {
+		t.Fatalf("got %v, want the publisher's error", err)
+	}
+	if n := o.Pending(); n != 0 {
+		t.Fatalf("got %d pending, want 0", n)
+	}
+}
+
+func TestOutboxPublishBatch(t *testing.T) {
+	b := newTestBroker(t)
+	deliveries, _ := consumeGameLogs(t, b)
+	pub := &gatedPublisher{b: b}
+	o := openTestOutbox(t, pub, filepath.Join(t.TempDir(), "alice.outbox"))
+
+	msgs := []Publishing{{Body: []byte("1")}, {Body: []byte("2")}}
+	for _, err := range o.PublishBatch(context.Background(), routing.ExchangePerilTopic, routing.GameLogSlug+".alice", msgs, false) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := o.Pending(); n != 0 {
+		t.Fatalf("got %d pending, want 0", n)
+	}
+	expectBodies(t, deliveries, "1", "2")
+}
+
+func TestOutboxReloadsAfterPartialRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alice.outbox")
+	o, err := NewOutbox(&gatedPublisher{fail: disconnected}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishToOutbox(t, o, "1", "2")
+	o.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A crash while appending leaves a length prefix promising more bytes
+	// than follow it.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 'x', 'y'})
+	f.Close()
+
+	b := newTestBroker(t)
+	deliveries, _ := consumeGameLogs(t, b)
+	o = openTestOutbox(t, &gatedPublisher{b: b}, path)
+	if n := o.Pending(); n != 2 {
+		t.Fatalf("got %d pending after reload, want 2", n)
+	}
+	repaired, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired.Size() != info.Size() {
+		t.Fatalf("outbox is %d bytes after repair, want %d", repaired.Size(), info.Size())
+	}
+
+	err = o.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBodies(t, deliveries, "1", "2")
+
+	// Flushed messages are gone from the file too.
+	o.Close()
+	o = openTestOutbox(t, &gatedPublisher{b: b}, path)
+	if n := o.Pending(); n != 0 {
+		t.Fatalf("got %d pending after flushing and reloading, want 0", n)
+	}
+}
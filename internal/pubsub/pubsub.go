@@ -1,56 +1,132 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
-	"log"
-
-	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
-	amqp "github.com/rabbitmq/amqp091-go"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
 )
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	body, err := json.Marshal(val)
+const defaultConfirmTimeout = 5 * time.Second
+
+var ErrConfirmsUnsupported = errors.New("pubsub: publisher does not support confirms")
+
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	confirm       bool
+	correlationID string
+	replyTo       string
+	schemaVersion int
+	encoding      string
+	compressAbove int
+
+	encryptionKeyID string
+}
+
+// WithConfirm makes a publish wait until the broker acks or nacks the
+// message. Without a deadline on the context the wait is capped at five
+// seconds.
+func WithConfirm() PublishOption {
+	return func(o *publishOptions) {
+		o.confirm = true
+	}
+}
+
+// Publish marshals val with the codec registered for contentType and wraps
+// it in an envelope with a fresh message ID, the publish time, the app ID
+// and the schema version.
+func Publish[T any](ctx context.Context, pub Publisher, contentType, exchange, key string, val T, opts ...PublishOption) error {
+	codec, err := codecFor(contentType)
 	if err != nil {
-		log.Println(err)
+		return err
+	}
+	body, err := codec.Marshal(val)
+	if err != nil {
+		currentLogger().Error("could not marshal message", "content_type", contentType, "exchange", exchange, "routing_key", key, "error", err)
 		return err
 	}
 
-	return ch.PublishWithContext(
-		context.Background(),
-		exchange,
-		key,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
-}
-
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(val)
+	msg, err := newPublishing(contentType, body, newPublishOptions(opts))
 	if err != nil {
-		log.Println(err)
 		return err
 	}
+	return publish(ctx, pub, exchange, key, msg, opts)
+}
 
-	return ch.PublishWithContext(
-		context.Background(),
-		exchange,
-		key,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/gob",
-			Body:        buf.Bytes(),
+func newPublishing(contentType string, body []byte, o publishOptions) (Publishing, error) {
+	body, encoding, err := compress(body, o)
+	if err != nil {
+		return Publishing{}, err
+	}
+	msg := Publishing{
+		ContentType:     contentType,
+		ContentEncoding: encoding,
+		MessageID:       newMessageID(),
+		CorrelationID:   o.correlationID,
+		AppID:           currentAppID(),
+		ReplyTo:         o.replyTo,
+		Timestamp:       time.Now().UTC(),
+		Headers: Table{
+			SchemaVersionHeader: int64(o.schemaVersion),
 		},
-	)
+		Body: body,
+	}
+	if o.encryptionKeyID != "" {
+		msg.Body, err = encrypt(o.encryptionKeyID, msg.MessageID, msg.Body)
+		if err != nil {
+			return Publishing{}, err
+		}
+		msg.Headers[EncryptionKeyHeader] = o.encryptionKeyID
+	}
+	return msg, nil
+}
+
+func PublishJSON[T any](ctx context.Context, pub Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ctx, pub, ContentTypeJSON, exchange, key, val, opts...)
+}
+
+func PublishGob[T any](ctx context.Context, pub Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ctx, pub, ContentTypeGob, exchange, key, val, opts...)
+}
+
+func newPublishOptions(opts []PublishOption) publishOptions {
+	o := publishOptions{
+		schemaVersion: defaultSchemaVersion,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func publish(ctx context.Context, pub Publisher, exchange, key string, msg Publishing, opts []PublishOption) (err error) {
+	defer func() { recordPublish(exchange, key, err) }()
+	o := newPublishOptions(opts)
+
+	ctx, span := startPublishSpan(ctx, exchange, key, &msg)
+	if span != nil {
+		defer func() { span.finish(err) }()
+	}
+
+	if !o.confirm {
+		return pub.Publish(ctx, exchange, key, msg)
+	}
+	confirmer, ok := pub.(Confirmer)
+	if !ok {
+		return ErrConfirmsUnsupported
+	}
+	ctx, cancel := withConfirmTimeout(ctx)
+	defer cancel()
+	return confirmer.PublishConfirmed(ctx, exchange, key, msg)
+}
+
+func withConfirmTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, defaultConfirmTimeout)
 }
 
 type SimpleQueueType int
@@ -63,136 +139,210 @@ const (
 	NackDiscard
 )
 
+// Durable queues outlive the broker restarting. Transient queues are
+// exclusive to one consumer and deleted when it goes away. Shared queues
+// are deleted once their last consumer goes away, but until then any
+// number of processes can consume from them.
 const (
 	Durable SimpleQueueType = iota
 	Transient
+	Shared
 )
 
-func DeclareAndBind(
-	conn *amqp.Connection,
-	exchange,
-	queueName,
-	key string,
-	queueType SimpleQueueType, // an enum to represent "durable" or "transient"
-) (*amqp.Channel, amqp.Queue, error) {
-	ch, err := conn.Channel()
-	if err != nil {
-		return nil, amqp.Queue{}, err
-	}
+type SubscribeOption func(*subscribeOptions)
 
-	durable := queueType == Durable
-	autoDelete := queueType == Transient
-	exclusive := queueType == Transient
-	args := amqp.Table{
-		"x-dead-letter-exchange": routing.ExchangePerilDLX,
-	}
-	queue, err := ch.QueueDeclare(
-		queueName,
-		durable,
-		autoDelete,
-		exclusive,
-		false,
-		args,
-	)
+type subscribeOptions struct {
+	prefetch    int
+	concurrency int
+	orderedKeys bool
+	retry       *RetryPolicy
+	middleware  []Middleware
+	panicAck    AckType
+	onPanic     func(context.Context, *PanicError)
+	logger      *slog.Logger
+}
 
-	if err != nil {
-		ch.Close()
-		return nil, amqp.Queue{}, err
+// WithPrefetch sets how many unacknowledged deliveries the broker may push
+// to the subscription at once. The default is 10.
+func WithPrefetch(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.prefetch = n
 	}
+}
 
-	err = ch.QueueBind(
-		queue.Name,
-		key,
-		exchange,
-		false,
-		nil,
-	)
-
-	if err != nil {
-		ch.Close()
-		return nil, amqp.Queue{}, err
+// WithConcurrency sets how many handlers run in parallel. The default is 1.
+// Prefetch should be at least as large for the workers to be kept busy.
+func WithConcurrency(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.concurrency = n
 	}
+}
 
-	return ch, queue, nil
+// WithOrderedKeys keeps messages with the same routing key in order when
+// running with more than one worker.
+func WithOrderedKeys() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.orderedKeys = true
+	}
 }
 
 func subscribe[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	sub Subscriber,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
-	handler func(T) AckType,
-	unmarshaller func([]byte) (T, error),
-) error {
-	ch, q, err := DeclareAndBind(conn, exchange, queueName, key, simpleQueueType)
-	if err != nil {
-		return err
+	handler func(Message[T]) AckType,
+	defaultContentType string,
+	opts []SubscribeOption,
+) (*Subscription, error) {
+	o := subscribeOptions{
+		prefetch:    10,
+		concurrency: 1,
+		panicAck:    NackDiscard,
+		onPanic:     logPanic,
 	}
-	err = ch.Qos(10, 0, false)
-	if err != nil {
-		ch.Close()
-		return err
+	for _, opt := range opts {
+		opt(&o)
 	}
-	deliveries, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+
+	var r *retrier
+	if o.retry != nil {
+		var err error
+		r, err = newRetrier(sub, queueName, simpleQueueType, *o.retry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	deliveries, err := sub.Consume(ctx, exchange, queueName, key, simpleQueueType, o.prefetch)
 	if err != nil {
-		return err
+		cancel()
+		return nil, err
 	}
 
+	rj := newRejecter(sub, queueName)
+	handle := chain(func(ctx context.Context, d Delivery) AckType {
+		msg, err := decode[T](d, defaultContentType)
+		if errors.Is(err, ErrUnknownEncryptionKey) {
+			// Encrypted for someone else; leave it for a subscriber
+			// that has the key.
+			Logger(ctx).Debug("no key for message, requeueing", "error", err)
+			return NackRequeue
+		}
+		if err != nil {
+			decodeFailuresTotal.Inc(queueName, d.Exchange, routingKeyLabel(d.RoutingKey))
+			return Reject(ctx, fmt.Sprintf("could not decode: %v", err))
+		}
+		err = validate(msg)
+		if err != nil {
+			return Reject(ctx, fmt.Sprintf("invalid message: %v", err))
+		}
+		return handler(newMessage(ctx, d, msg))
+	}, o.middleware)
+	handle = recoverPanics(handle, o.panicAck, o.onPanic)
+
+	s := newSubscription(cancel)
 	go func() {
-		for d := range deliveries {
-			msg, err := unmarshaller(d.Body)
-			if err != nil {
-				d.Nack(false, false)
-				continue
+		dispatch(deliveries, o.concurrency, o.orderedKeys, func(d Delivery) {
+			ctx, rejected := withRejection(ctx)
+			ctx, _, span := startSpan(ctx, traceParent(d), "process "+queueName, "consumer", map[string]string{
+				"queue":       queueName,
+				"exchange":    d.Exchange,
+				"routing_key": d.RoutingKey,
+				"message_id":  d.MessageID,
+			})
+			ctx = deliveryLogger(ctx, o.logger, queueName, d)
+			consumedTotal.Inc(queueName, d.Exchange, routingKeyLabel(d.RoutingKey))
+			start := time.Now()
+			ackType := handle(ctx, d)
+			handlerSeconds.ObserveDuration(time.Since(start), queueName, d.Exchange, routingKeyLabel(d.RoutingKey))
+			settledTotal.Inc(queueName, d.Exchange, routingKeyLabel(d.RoutingKey), outcomeLabel(ackType))
+			span.Attributes["outcome"] = outcomeLabel(ackType)
+			var spanErr error
+			if rejected.reason != "" {
+				spanErr = errors.New(rejected.reason)
 			}
-
-			ackType := handler(msg)
-
+			span.finish(spanErr)
 			switch ackType {
 			case Ack:
-				log.Println("Acknowledging message")
-				d.Ack(false)
+				d.Ack()
 			case NackRequeue:
-				log.Println("Nacking message with requeue")
-				d.Nack(false, true)
+				if r != nil {
+					r.retry(ctx, d)
+					return
+				}
+				d.Nack(true)
 			case NackDiscard:
-				log.Println("Nacking message without requeue (discarding)")
-				d.Nack(false, false)
+				if rejected.reason != "" && rj != nil {
+					rj.reject(ctx, d, rejected.reason)
+					return
+				}
+				d.Nack(false)
 			}
+		})
+
+		err := ctx.Err()
+		if err == nil {
+			err = ErrDeliveriesClosed
 		}
+		s.finish(err)
 	}()
 
-	return nil
+	return s, nil
+}
+
+// decode unmarshals a delivery with the codec for its content type, using
+// defaultContentType for deliveries that don't declare one.
+func decode[T any](d Delivery, defaultContentType string) (T, error) {
+	var msg T
+	err := unmarshalPublishing(d.Publishing, defaultContentType, &msg)
+	return msg, err
+}
+
+// Subscribe decodes each delivery with the codec registered for its
+// content type.
+func Subscribe[T any](
+	ctx context.Context,
+	sub Subscriber,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(T) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(ctx, sub, exchange, queueName, key, queueType, bodyOnly(handler), "", opts)
 }
 
+// SubscribeJSON is Subscribe for publishers that may not set a content
+// type: deliveries without one are decoded as JSON.
 func SubscribeJSON[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	sub Subscriber,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
 	handler func(T) AckType,
-) error {
-	return subscribe(conn, exchange, queueName, key, queueType, handler, func(body []byte) (T, error) {
-		var msg T
-		err := json.Unmarshal(body, &msg)
-		return msg, err
-	})
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(ctx, sub, exchange, queueName, key, queueType, bodyOnly(handler), ContentTypeJSON, opts)
 }
 
+// SubscribeGob is Subscribe for publishers that may not set a content
+// type: deliveries without one are decoded as gob.
 func SubscribeGob[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	sub Subscriber,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
 	handler func(T) AckType,
-) error {
-	return subscribe(conn, exchange, queueName, key, simpleQueueType, handler, func(body []byte) (T, error) {
-		var msg T
-		dec := gob.NewDecoder(bytes.NewReader(body))
-		err := dec.Decode(&msg)
-		return msg, err
-	})
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(ctx, sub, exchange, queueName, key, simpleQueueType, bodyOnly(handler), ContentTypeGob, opts)
 }
@@ -0,0 +1,100 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitPolicy is a token bucket per key: each key may handle Burst
+// deliveries at once and Rate more every second after that.
+type RateLimitPolicy struct {
+	Rate  float64
+	Burst int
+	// Exceeded settles deliveries over the limit. NackDiscard drops them
+	// to the dead-letter exchange; NackRequeue defers them, which only
+	// makes sense with WithRetry to delay their return.
+	Exceeded AckType
+	// Key picks the bucket for a delivery. It defaults to
+	// RoutingKeySuffix.
+	Key func(d Delivery) string
+	// OnExceeded, if set, is called for every delivery over the limit with
+	// the delivery's context.
+	OnExceeded func(ctx context.Context, key string, d Delivery)
+}
+
+// RoutingKeySuffix returns the last dot-separated segment of the routing
+// key, which for per-player keys such as game_logs.<username> is the
+// player.
+func RoutingKeySuffix(d Delivery) string {
+	return d.RoutingKey[strings.LastIndex(d.RoutingKey, ".")+1:]
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimit settles deliveries over policy's limit without handling them.
+func RateLimit(policy RateLimitPolicy) Middleware {
+	if policy.Key == nil {
+		policy.Key = RoutingKeySuffix
+	}
+	// A bucket left alone until it refills is the same as a new one, so
+	// those are swept out now and then rather than kept for every key ever
+	// seen.
+	var refill time.Duration
+	if policy.Rate > 0 {
+		refill = time.Duration(float64(policy.Burst) / policy.Rate * float64(time.Second))
+	}
+	var (
+		mu        sync.Mutex
+		buckets   = map[string]*tokenBucket{}
+		lastSweep time.Time
+	)
+	allow := func(key string, now time.Time) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if policy.Rate > 0 && now.Sub(lastSweep) >= max(refill, time.Minute) {
+			for k, b := range buckets {
+				if b.tokens+now.Sub(b.last).Seconds()*policy.Rate >= float64(policy.Burst) {
+					delete(buckets, k)
+				}
+			}
+			lastSweep = now
+		}
+		b, ok := buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: float64(policy.Burst), last: now}
+			buckets[key] = b
+		}
+		b.tokens += now.Sub(b.last).Seconds() * policy.Rate
+		if b.tokens > float64(policy.Burst) {
+			b.tokens = float64(policy.Burst)
+		}
+		b.last = now
+		if b.tokens < 1 {
+			return false
+		}
+		b.tokens--
+		return true
+	}
+
+	return func(next DeliveryHandler) DeliveryHandler {
+		return func(ctx context.Context, d Delivery) AckType {
+			key := policy.Key(d)
+			if allow(key, time.Now()) {
+				return next(ctx, d)
+			}
+			if policy.OnExceeded != nil {
+				policy.OnExceeded(ctx, key, d)
+			}
+			if policy.Exceeded == NackDiscard {
+				return Reject(ctx, fmt.Sprintf("rate limit exceeded for %q", key))
+			}
+			return policy.Exceeded
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	reconnectMinBackoff = 500 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+var (
+	ErrNotConnected  = errors.New("pubsub: not connected to broker")
+	ErrManagerClosed = errors.New("pubsub: connection manager closed")
+)
+
+// ConnectionManager owns an AMQP connection and replaces it whenever the
+// broker goes away. Subscriptions made through it are re-declared, re-bound
+// and resumed on the new connection, so their delivery channels stay open
+// across broker restarts.
+type ConnectionManager struct {
+	url string
+
+	mu          sync.RWMutex
+	conn        *amqp.Connection
+	broker      *AMQPBroker
+	ready       chan struct{}
+	closed      bool
+	done        chan struct{}
+	onReconnect []func()
+	topology    *routing.Topology
+}
+
+type managedSubscription struct {
+	ctx      context.Context
+	exchange string
+	spec     QueueSpec
+	key      string
+	prefetch int
+	out      chan Delivery
+}
+
+func NewConnectionManager(url string) (*ConnectionManager, error) {
+	m := &ConnectionManager{
+		url:   url,
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	err := m.connect()
+	if err != nil {
+		return nil, err
+	}
+	go m.watch()
+	return m, nil
+}
+
+// OnReconnect registers fn to run in its own goroutine every time the
+// manager reconnects after losing the connection.
+func (m *ConnectionManager) OnReconnect(fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onReconnect = append(m.onReconnect, fn)
+}
+
+// ApplyTopology declares t and declares it again on every new connection
+// before subscriptions are resumed, so they find their exchanges, queues
+// and bindings even if the broker lost them.
+func (m *ConnectionManager) ApplyTopology(ctx context.Context, t routing.Topology) error {
+	m.mu.Lock()
+	m.topology = &t
+	m.mu.Unlock()
+	return ApplyTopology(ctx, m, t)
+}
+
+func (m *ConnectionManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	close(m.done)
+	if m.broker != nil {
+		m.broker.Close()
+	}
+	if m.conn != nil {
+		return m.conn.Close()
+	}
+	return nil
+}
+
+func (m *ConnectionManager) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+	b, err := m.current()
+	if err != nil {
+		return err
+	}
+	return b.Publish(ctx, exchange, key, msg)
+}
+
+func (m *ConnectionManager) PublishConfirmed(ctx context.Context, exchange, key string, msg Publishing) error {
+	b, err := m.current()
+	if err != nil {
+		return err
+	}
+	return b.PublishConfirmed(ctx, exchange, key, msg)
+}
+
+func (m *ConnectionManager) PublishBatch(ctx context.Context, exchange, key string, msgs []Publishing, confirm bool) []error {
+	b, err := m.current()
+	if err != nil {
+		errs := make([]error, len(msgs))
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	return b.PublishBatch(ctx, exchange, key, msgs, confirm)
+}
+
+func (m *ConnectionManager) Consume(
+	ctx context.Context,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	prefetch int,
+) (<-chan Delivery, error) {
+	return m.ConsumeQueue(ctx, simpleQueueSpec(queueName, queueType), exchange, key, prefetch)
+}
+
+func (m *ConnectionManager) ConsumeQueue(ctx context.Context, spec QueueSpec, exchange, key string, prefetch int) (<-chan Delivery, error) {
+	b, err := m.current()
+	if err != nil {
+		return nil, err
+	}
+	in, err := b.ConsumeQueue(ctx, spec, exchange, key, prefetch)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &managedSubscription{
+		ctx:      ctx,
+		exchange: exchange,
+		spec:     spec,
+		key:      key,
+		prefetch: prefetch,
+		out:      make(chan Delivery),
+	}
+	go m.pump(s, in)
+	return s.out, nil
+}
+
+func (m *ConnectionManager) DeclareQueue(ctx context.Context, spec QueueSpec) error {
+	b, err := m.current()
+	if err != nil {
+		return err
+	}
+	return b.DeclareQueue(ctx, spec)
+}
+
+func (m *ConnectionManager) DeclareExchange(ctx context.Context, name, kind string, durable bool) error {
+	b, err := m.current()
+	if err != nil {
+		return err
+	}
+	return b.DeclareExchange(ctx, name, kind, durable)
+}
+
+func (m *ConnectionManager) BindQueue(ctx context.Context, queue, key, exchange string) error {
+	b, err := m.current()
+	if err != nil {
+		return err
+	}
+	return b.BindQueue(ctx, queue, key, exchange)
+}
+
+func (m *ConnectionManager) CheckExchange(ctx context.Context, name, kind string, durable bool) error {
+	b, err := m.current()
+	if err != nil {
+		return err
+	}
+	return b.CheckExchange(ctx, name, kind, durable)
+}
+
+func (m *ConnectionManager) CheckQueue(ctx context.Context, spec QueueSpec) error {
+	b, err := m.current()
+	if err != nil {
+		return err
+	}
+	return b.CheckQueue(ctx, spec)
+}
+
+func (m *ConnectionManager) CheckBinding(ctx context.Context, queue, key, exchange string) error {
+	b, err := m.current()
+	if err != nil {
+		return err
+	}
+	return b.CheckBinding(ctx, queue, key, exchange)
+}
+
+func (m *ConnectionManager) current() (*AMQPBroker, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, ErrManagerClosed
+	}
+	if m.broker == nil {
+		return nil, ErrNotConnected
+	}
+	return m.broker, nil
+}
+
+func (m *ConnectionManager) connect() error {
+	conn, err := amqp.Dial(m.url)
+	if err != nil {
+		return err
+	}
+	broker, err := NewAMQPBroker(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	m.mu.RLock()
+	topology := m.topology
+	m.mu.RUnlock()
+	if topology != nil {
+		err = ApplyTopology(context.Background(), broker, *topology)
+		if err != nil {
+			broker.Close()
+			conn.Close()
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		broker.Close()
+		conn.Close()
+		return ErrManagerClosed
+	}
+	m.conn = conn
+	m.broker = broker
+	close(m.ready)
+	return nil
+}
+
+func (m *ConnectionManager) disconnected() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conn = nil
+	m.broker = nil
+	m.ready = make(chan struct{})
+}
+
+func (m *ConnectionManager) readyChan() <-chan struct{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ready
+}
+
+func (m *ConnectionManager) watch() {
+	for {
+		m.mu.RLock()
+		conn := m.conn
+		m.mu.RUnlock()
+		closeErr := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+
+		select {
+		case <-m.done:
+			return
+		default:
+		}
+		currentLogger().Warn("lost connection to RabbitMQ", "error", closeErr)
+		m.disconnected()
+
+		backoff := reconnectMinBackoff
+		for {
+			select {
+			case <-m.done:
+				return
+			case <-time.After(backoff):
+			}
+			err := m.connect()
+			if err == nil {
+				currentLogger().Info("reconnected to RabbitMQ")
+				m.mu.RLock()
+				for _, fn := range m.onReconnect {
+					go fn()
+				}
+				m.mu.RUnlock()
+				break
+			}
+			if errors.Is(err, ErrManagerClosed) {
+				return
+			}
+			currentLogger().Warn("could not reconnect to RabbitMQ", "retry_in", backoff, "error", err)
+			backoff = min(backoff*2, reconnectMaxBackoff)
+		}
+	}
+}
+
+// pump forwards deliveries from the current connection to the caller and
+// resubscribes whenever the underlying delivery channel is closed by a
+// connection loss rather than by the caller.
+func (m *ConnectionManager) pump(s *managedSubscription, in <-chan Delivery) {
+	defer close(s.out)
+	for {
+		for d := range in {
+			select {
+			case s.out <- d:
+			case <-s.ctx.Done():
+				d.Nack(true)
+			}
+		}
+		in = m.resubscribe(s)
+		if in == nil {
+			return
+		}
+	}
+}
+
+func (m *ConnectionManager) resubscribe(s *managedSubscription) <-chan Delivery {
+	backoff := reconnectMinBackoff
+	for {
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case <-m.done:
+			return nil
+		case <-m.readyChan():
+		}
+
+		b, err := m.current()
+		if err == nil {
+			var in <-chan Delivery
+			in, err = b.ConsumeQueue(s.ctx, s.spec, s.exchange, s.key, s.prefetch)
+			if err == nil {
+				return in
+			}
+		}
+		currentLogger().Warn("could not resubscribe", "queue", s.spec.Name, "retry_in", backoff, "error", err)
+
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case <-m.done:
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
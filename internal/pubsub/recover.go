@@ -0,0 +1,77 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError describes a handler that panicked while handling a delivery.
+type PanicError struct {
+	Value       any
+	Stack       []byte
+	Exchange    string
+	RoutingKey  string
+	DeliveryTag uint64
+	ContentType string
+	Redelivered bool
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panicked on delivery %d from %q (routing key %q): %v",
+		e.DeliveryTag, e.Exchange, e.RoutingKey, e.Value)
+}
+
+// WithPanicAck sets how a delivery is settled when its handler panics.
+// The default is NackDiscard, which sends it to the dead-letter exchange.
+func WithPanicAck(ackType AckType) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.panicAck = ackType
+	}
+}
+
+// WithPanicHandler replaces the default report for handler panics, which
+// logs the panic, the delivery metadata and the stack trace. report gets
+// the delivery's context, so Logger(ctx) logs with the delivery's fields.
+func WithPanicHandler(report func(context.Context, *PanicError)) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.onPanic = report
+	}
+}
+
+func logPanic(ctx context.Context, e *PanicError) {
+	Logger(ctx).Error("handler panicked",
+		"content_type", e.ContentType,
+		"redelivered", e.Redelivered,
+		"panic", fmt.Sprint(e.Value),
+		"stack", string(e.Stack),
+	)
+}
+
+// recoverPanics settles deliveries whose handler panics with ackType
+// instead of letting the panic kill the process. It wraps the whole chain,
+// so panics in middleware are caught too.
+func recoverPanics(next DeliveryHandler, ackType AckType, report func(context.Context, *PanicError)) DeliveryHandler {
+	return func(ctx context.Context, d Delivery) (result AckType) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			report(ctx, &PanicError{
+				Value:       v,
+				Stack:       debug.Stack(),
+				Exchange:    d.Exchange,
+				RoutingKey:  d.RoutingKey,
+				DeliveryTag: d.DeliveryTag,
+				ContentType: d.ContentType,
+				Redelivered: d.Redelivered,
+			})
+			result = ackType
+			if ackType == NackDiscard {
+				result = Reject(ctx, fmt.Sprintf("handler panicked: %v", v))
+			}
+		}()
+		return next(ctx, d)
+	}
+}
@@ -0,0 +1,150 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	RetryAttemptHeader    = "x-retry-attempt"
+	RetryExchangeHeader   = "x-retry-exchange"
+	RetryRoutingKeyHeader = "x-retry-routing-key"
+)
+
+var ErrRetryUnsupported = errors.New("pubsub: retries need a named queue on a broker that can publish and declare queues")
+
+// RetryPolicy controls delayed redelivery of messages whose handler
+// returned NackRequeue. Instead of going straight back to the head of the
+// queue, the message waits in a retry queue for InitialDelay, doubling on
+// every attempt up to MaxDelay. Once MaxAttempts retries have failed the
+// message is discarded to the dead-letter exchange.
+type RetryPolicy struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// WithRetry turns NackRequeue into a delayed retry. Zero fields in policy
+// fall back to 5 attempts starting at one second and capped at one minute.
+func WithRetry(policy RetryPolicy) SubscribeOption {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 5
+	}
+	if policy.InitialDelay <= 0 {
+		policy.InitialDelay = time.Second
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = time.Minute
+	}
+	return func(o *subscribeOptions) {
+		o.retry = &policy
+	}
+}
+
+type retrier struct {
+	pub       Publisher
+	declarer  QueueDeclarer
+	queueName string
+	queueType SimpleQueueType
+	policy    RetryPolicy
+}
+
+func newRetrier(sub Subscriber, queueName string, queueType SimpleQueueType, policy RetryPolicy) (*retrier, error) {
+	pub, ok := sub.(Publisher)
+	if !ok {
+		return nil, ErrRetryUnsupported
+	}
+	declarer, ok := sub.(QueueDeclarer)
+	if !ok || queueName == "" {
+		return nil, ErrRetryUnsupported
+	}
+	return &retrier{
+		pub:       pub,
+		declarer:  declarer,
+		queueName: queueName,
+		queueType: queueType,
+		policy:    policy,
+	}, nil
+}
+
+func (r *retrier) delay(attempt int) time.Duration {
+	delay := r.policy.InitialDelay
+	for i := 1; i < attempt && delay < r.policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, r.policy.MaxDelay)
+}
+
+// retryQueue describes the queue a message waits in before its given retry
+// attempt. Expired messages are dead-lettered through the default exchange
+// straight back to the original queue, so other queues bound to the same
+// routing key don't see the retry.
+func (r *retrier) retryQueue(delay time.Duration) QueueSpec {
+	args := Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": r.queueName,
+	}
+	if r.queueType != Durable {
+		args["x-expires"] = (delay + time.Minute).Milliseconds()
+	}
+	return QueueSpec{
+		Name:    fmt.Sprintf("%s.retry.%s", r.queueName, delay),
+		Durable: r.queueType == Durable,
+		Args:    args,
+	}
+}
+
+// retry settles a delivery whose handler asked for it to be requeued.
+func (r *retrier) retry(ctx context.Context, d Delivery) {
+	attempt := 1
+	if prev, ok := tableInt(d.Headers, RetryAttemptHeader); ok {
+		attempt = int(prev) + 1
+	}
+	if attempt > r.policy.MaxAttempts {
+		Logger(ctx).Warn("giving up on message, discarding", "retries", r.policy.MaxAttempts)
+		d.Nack(false)
+		return
+	}
+
+	delay := r.delay(attempt)
+	queue := r.retryQueue(delay)
+	err := r.declarer.DeclareQueue(ctx, queue)
+	if err != nil {
+		Logger(ctx).Error("could not declare retry queue, requeueing", "retry_queue", queue.Name, "error", err)
+		d.Nack(true)
+		return
+	}
+
+	msg := d.Publishing
+	msg.Headers = cloneTable(d.Headers)
+	msg.Headers[RetryAttemptHeader] = int64(attempt)
+	msg.Headers[RetryExchangeHeader] = d.Exchange
+	msg.Headers[RetryRoutingKeyHeader] = d.RoutingKey
+	err = publish(ctx, r.pub, "", queue.Name, msg, []PublishOption{WithConfirm()})
+	if err != nil {
+		Logger(ctx).Error("could not schedule retry, requeueing", "error", err)
+		d.Nack(true)
+		return
+	}
+	Logger(ctx).Info("retrying message", "delay", delay, "attempt", attempt, "max_attempts", r.policy.MaxAttempts)
+	d.Ack()
+}
+
+// restoreRouting puts back the exchange and routing key a retried delivery
+// was originally published with, since dead-lettering out of the retry
+// queue replaces them.
+func restoreRouting(d Delivery) Delivery {
+	if _, ok := tableInt(d.Headers, RetryAttemptHeader); !ok {
+		return d
+	}
+	if exchange, ok := d.Headers[RetryExchangeHeader].(string); ok {
+		d.Exchange = exchange
+	}
+	if key, ok := d.Headers[RetryRoutingKeyHeader].(string); ok {
+		d.RoutingKey = key
+	}
+	return d
+}
@@ -0,0 +1,107 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestRetryDelay(t *testing.T) {
+	r := &retrier{policy: RetryPolicy{MaxAttempts: 5, InitialDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}}
+	for attempt, want := range map[int]time.Duration{
+		1: 10 * time.Millisecond,
+		2: 20 * time.Millisecond,
+		3: 40 * time.Millisecond,
+		4: 50 * time.Millisecond,
+		5: 50 * time.Millisecond,
+	} {
+		if got := r.delay(attempt); got != want {
+			t.Errorf("delay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestRetryRoundTrip(t *testing.T) {
+	b := newTestBroker(t)
+	deadLetters := consumeDeadLetters(t, b)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type attempt struct {
+		d  Delivery
+		at time.Time
+	}
+	attempts := make(chan attempt, 10)
+	_, err := SubscribeMessage(ctx, b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", Durable, func(m Message[routing.GameLog]) AckType {
+		attempts <- attempt{m.Delivery, time.Now()}
+		return NackRequeue
+	}, WithRetry(RetryPolicy{MaxAttempts: 2, InitialDelay: 20 * time.Millisecond, MaxDelay: 30 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = PublishJSON(ctx, b, routing.ExchangePerilTopic, routing.GameLogSlug+".alice", routing.GameLog{Username: "alice", Message: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first delivery and one per retry, each waiting out its delay.
+	var last time.Time
+	for i, delay := range []time.Duration{0, 20 * time.Millisecond, 30 * time.Millisecond} {
+		var a attempt
+		select {
+		case a = <-attempts:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for attempt %d", i)
+		}
+		n, ok := tableInt(a.d.Headers, RetryAttemptHeader)
+		if i == 0 && ok || i > 0 && n != int64(i) {
+			t.Fatalf("delivery %d has %s %v", i, RetryAttemptHeader, a.d.Headers[RetryAttemptHeader])
+		}
+		if a.d.Exchange != routing.ExchangePerilTopic || a.d.RoutingKey != "game_logs.alice" {
+			t.Fatalf("delivery %d came from %q with routing key %q", i, a.d.Exchange, a.d.RoutingKey)
+		}
+		if i > 0 && a.at.Sub(last) < delay {
+			t.Fatalf("retry %d came after %v, want at least %v", i, a.at.Sub(last), delay)
+		}
+		last = a.at
+	}
+
+	// Out of attempts, so dead-lettered rather than retried again.
+	dl := receive(t, deadLetters)
+	if n, _ := tableInt(dl.Headers, RetryAttemptHeader); n != 2 {
+		t.Fatalf("dead letter has %s %v, want 2", RetryAttemptHeader, dl.Headers[RetryAttemptHeader])
+	}
+	select {
+	case <-attempts:
+		t.Fatal("message retried after MaxAttempts")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRestoreRouting(t *testing.T) {
+	// A message dead-lettered out of a retry queue arrives through the
+	// default exchange, addressed to the queue.
+	d := Delivery{
+		Exchange:   "",
+		RoutingKey: routing.GameLogSlug,
+		Publishing: Publishing{Headers: Table{
+			RetryAttemptHeader:    int64(1),
+			RetryExchangeHeader:   routing.ExchangePerilTopic,
+			RetryRoutingKeyHeader: "game_logs.alice",
+		}},
+	}
+	got := restoreRouting(d)
+	if got.Exchange != routing.ExchangePerilTopic || got.RoutingKey != "game_logs.alice" {
+		t.Fatalf("restored %q with routing key %q", got.Exchange, got.RoutingKey)
+	}
+
+	// Without an attempt the headers aren't the retrier's, so leave it be.
+	delete(d.Headers, RetryAttemptHeader)
+	got = restoreRouting(d)
+	if got.Exchange != "" || got.RoutingKey != routing.GameLogSlug {
+		t.Fatalf("first delivery rerouted to %q with routing key %q", got.Exchange, got.RoutingKey)
+	}
+}
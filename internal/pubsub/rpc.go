@@ -0,0 +1,205 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// RPCErrorHeader carries the error returned by a Serve handler in place of
+// a response body.
+const RPCErrorHeader = "x-rpc-error"
+
+const defaultRequestTimeout = 5 * time.Second
+
+var ErrRequestTimeout = errors.New("pubsub: request timed out")
+
+// RemoteError is an error returned by the handler serving a request.
+type RemoteError struct {
+	Key     string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("pubsub: %s: %s", e.Key, e.Message)
+}
+
+// Broker is a transport that can both publish and subscribe.
+type Broker interface {
+	Publisher
+	Subscriber
+}
+
+// Serve answers requests sent to key on peril_direct with handler. The
+// request queue is shared, so several servers can serve a key and each
+// request goes to one of them. Requests made while none is running time
+// out.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	b Broker,
+	key string,
+	handler func(Req) (Resp, error),
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return ServeMessage(ctx, b, key, func(m Message[Req]) (Resp, error) {
+		return handler(m.Body)
+	}, opts...)
+}
+
+// ServeMessage is like Serve but passes handler the whole request, for
+// handlers that need to know who signed it.
+func ServeMessage[Req, Resp any](
+	ctx context.Context,
+	b Broker,
+	key string,
+	handler func(Message[Req]) (Resp, error),
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(ctx, b, routing.ExchangePerilDirect, key, key, Shared, func(m Message[Req]) AckType {
+		if m.Delivery.ReplyTo == "" {
+			return NackDiscard
+		}
+
+		reply := Publishing{
+			ContentType:   m.Delivery.ContentType,
+			MessageID:     newMessageID(),
+			CorrelationID: m.CorrelationID,
+			AppID:         currentAppID(),
+			Timestamp:     time.Now().UTC(),
+		}
+		resp, err := handler(m)
+		if err == nil {
+			var codec Codec
+			codec, err = codecFor(reply.ContentType)
+			if err == nil {
+				reply.Body, err = codec.Marshal(resp)
+			}
+		}
+		if err != nil {
+			reply.Headers = Table{RPCErrorHeader: err.Error()}
+			reply.Body = nil
+		}
+
+		err = publish(m.Context(), b, "", m.Delivery.ReplyTo, reply, nil)
+		if err != nil {
+			return NackRequeue
+		}
+		return Ack
+	}, ContentTypeJSON, opts)
+}
+
+// RPCClient sends requests and routes replies back to the callers waiting
+// for them. Replies arrive on an exclusive queue owned by the client.
+type RPCClient struct {
+	queue string
+	sub   *Subscription
+
+	mu      sync.Mutex
+	pub     Publisher
+	pending map[string]chan Delivery
+}
+
+func NewRPCClient(ctx context.Context, b Broker) (*RPCClient, error) {
+	c := &RPCClient{
+		pub:     b,
+		queue:   "rpc.reply." + newMessageID(),
+		pending: map[string]chan Delivery{},
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	deliveries, err := b.Consume(ctx, "", c.queue, c.queue, Transient, 0)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	c.sub = newSubscription(cancel)
+	go func() {
+		for d := range deliveries {
+			c.mu.Lock()
+			reply, ok := c.pending[d.CorrelationID]
+			delete(c.pending, d.CorrelationID)
+			c.mu.Unlock()
+			if ok {
+				reply <- d
+			}
+			d.Ack()
+		}
+
+		err := ctx.Err()
+		if err == nil {
+			err = ErrDeliveriesClosed
+		}
+		c.sub.finish(err)
+	}()
+	return c, nil
+}
+
+// SetPublisher changes the publisher requests are sent with, for example
+// to a SigningPublisher once the client has a key.
+func (c *RPCClient) SetPublisher(pub Publisher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pub = pub
+}
+
+// Close stops listening for replies. Requests still waiting time out.
+func (c *RPCClient) Close() error {
+	return c.sub.Close()
+}
+
+// Request sends req to the server for key on peril_direct and waits for
+// its response. Without a deadline on the context the wait is capped at
+// five seconds.
+func Request[Req, Resp any](ctx context.Context, c *RPCClient, key string, req Req) (Resp, error) {
+	var resp Resp
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRequestTimeout)
+		defer cancel()
+	}
+
+	id := newMessageID()
+	reply := make(chan Delivery, 1)
+	c.mu.Lock()
+	pub := c.pub
+	c.pending[id] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	err := Publish(ctx, pub, ContentTypeJSON, routing.ExchangePerilDirect, key, req,
+		WithCorrelationID(id),
+		withReplyTo(c.queue),
+	)
+	if err != nil {
+		return resp, err
+	}
+
+	select {
+	case d := <-reply:
+		if msg, ok := d.Headers[RPCErrorHeader].(string); ok {
+			return resp, &RemoteError{Key: key, Message: msg}
+		}
+		err = unmarshalPublishing(d.Publishing, "", &resp)
+		return resp, err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return resp, fmt.Errorf("%w: %s", ErrRequestTimeout, key)
+		}
+		return resp, ctx.Err()
+	}
+}
+
+func withReplyTo(queue string) PublishOption {
+	return func(o *publishOptions) {
+		o.replyTo = queue
+	}
+}
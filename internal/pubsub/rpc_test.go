@@ -0,0 +1,63 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestServeSeveralServers(t *testing.T) {
+	b := newTestBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	served := make(chan int, 10)
+	for i := range 2 {
+		_, err := Serve(ctx, b, "echo", func(req string) (string, error) {
+			served <- i
+			return fmt.Sprintf("%s from %d", req, i), nil
+		})
+		if err != nil {
+			t.Fatalf("server %d: %v", i, err)
+		}
+	}
+
+	c, err := NewRPCClient(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for range 4 {
+		_, err := Request[string, string](ctx, c, "echo", "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(served) != 4 {
+		t.Fatalf("got %d requests served, want 4", len(served))
+	}
+}
+
+func TestServeError(t *testing.T) {
+	b := newTestBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := Serve(ctx, b, "fail", func(req string) (string, error) {
+		return "", errors.New("no")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewRPCClient(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, err = Request[string, string](ctx, c, "fail", "hello")
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Message != "no" {
+		t.Fatalf("got %v, want a RemoteError", err)
+	}
+}
@@ -0,0 +1,203 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+const (
+	SignerHeader    = "x-signer"
+	SignatureHeader = "x-signature"
+)
+
+const signingKeySize = 32
+
+var (
+	ErrUnsigned      = errors.New("pubsub: message is not signed")
+	ErrBadSignature  = errors.New("pubsub: signature does not match")
+	ErrUnknownSigner = errors.New("pubsub: unknown signer")
+)
+
+// NewSigningKey returns a random key for HMAC-SHA256 signing.
+func NewSigningKey() []byte {
+	key := make([]byte, signingKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(fmt.Sprintf("pubsub: could not generate signing key: %v", err))
+	}
+	return key
+}
+
+// SigningPublisher signs every message with the signer's key before
+// passing it on to pub. The signature covers the body, the envelope and
+// where the message is published to, so it can't be replayed elsewhere.
+type SigningPublisher struct {
+	pub    Publisher
+	signer string
+	key    []byte
+}
+
+func NewSigningPublisher(pub Publisher, signer string, key []byte) *SigningPublisher {
+	return &SigningPublisher{
+		pub:    pub,
+		signer: signer,
+		key:    key,
+	}
+}
+
+func (p *SigningPublisher) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+	return p.pub.Publish(ctx, exchange, key, p.sign(exchange, key, msg))
+}
+
+func (p *SigningPublisher) PublishConfirmed(ctx context.Context, exchange, key string, msg Publishing) error {
+	confirmer, ok := p.pub.(Confirmer)
+	if !ok {
+		return ErrConfirmsUnsupported
+	}
+	return confirmer.PublishConfirmed(ctx, exchange, key, p.sign(exchange, key, msg))
+}
+
+func (p *SigningPublisher) PublishBatch(ctx context.Context, exchange, key string, msgs []Publishing, confirm bool) []error {
+	signed := make([]Publishing, len(msgs))
+	for i, msg := range msgs {
+		signed[i] = p.sign(exchange, key, msg)
+	}
+	if bp, ok := p.pub.(BatchPublisher); ok {
+		return bp.PublishBatch(ctx, exchange, key, signed, confirm)
+	}
+
+	errs := make([]error, len(signed))
+	for i, msg := range signed {
+		if confirm {
+			errs[i] = p.PublishConfirmed(ctx, exchange, key, msg)
+		} else {
+			errs[i] = p.pub.Publish(ctx, exchange, key, msg)
+		}
+	}
+	return errs
+}
+
+func (p *SigningPublisher) sign(exchange, key string, msg Publishing) Publishing {
+	msg.Headers = cloneTable(msg.Headers)
+	msg.Headers[SignerHeader] = p.signer
+	msg.Headers[SignatureHeader] = computeSignature(p.key, signedContent(exchange, key, msg))
+	return msg
+}
+
+// signedContent is what a signature covers: where the message was sent,
+// its envelope and a digest of its body. Headers aren't covered, since the
+// retry and dead-letter machinery rewrites them.
+func signedContent(exchange, key string, msg Publishing) []byte {
+	var timestamp int64
+	if !msg.Timestamp.IsZero() {
+		// AMQP only carries whole seconds.
+		timestamp = msg.Timestamp.Unix()
+	}
+	digest := sha256.Sum256(msg.Body)
+
+	var buf bytes.Buffer
+	for _, field := range []string{
+		exchange,
+		key,
+		msg.MessageID,
+		msg.CorrelationID,
+		msg.AppID,
+		msg.ReplyTo,
+		strconv.FormatInt(timestamp, 10),
+		msg.ContentType,
+		msg.ContentEncoding,
+		hex.EncodeToString(digest[:]),
+	} {
+		buf.WriteString(field)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func computeSignature(key, content []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(content)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Signer returns who signed d, or "" if it isn't signed. It is only
+// trustworthy after VerifySignatures has accepted the delivery.
+func Signer(d Delivery) string {
+	signer, _ := d.Headers[SignerHeader].(string)
+	return signer
+}
+
+// SignatureVerifier checks that signature is signer's signature of content.
+type SignatureVerifier interface {
+	VerifySignature(ctx context.Context, signer string, content []byte, signature string) error
+}
+
+// VerifySignatures rejects deliveries that are unsigned or whose signature
+// v doesn't accept. Rejected deliveries go to the dead-letter exchange with
+// the reason in their headers. v must report a signature it doesn't accept
+// with an error wrapping ErrBadSignature or ErrUnknownSigner; any other
+// error means the signature couldn't be checked, and the delivery is
+// requeued to be checked again.
+func VerifySignatures(v SignatureVerifier) Middleware {
+	return func(next DeliveryHandler) DeliveryHandler {
+		return func(ctx context.Context, d Delivery) AckType {
+			signer := Signer(d)
+			signature, _ := d.Headers[SignatureHeader].(string)
+			if signer == "" || signature == "" {
+				return Reject(ctx, ErrUnsigned.Error())
+			}
+			err := v.VerifySignature(ctx, signer, signedContent(d.Exchange, d.RoutingKey, d.Publishing), signature)
+			if errors.Is(err, ErrBadSignature) || errors.Is(err, ErrUnknownSigner) {
+				return Reject(ctx, fmt.Sprintf("signature from %q not accepted: %v", signer, err))
+			}
+			if err != nil {
+				Logger(ctx).Warn("could not verify signature, requeueing", "signer", signer, "error", err)
+				return NackRequeue
+			}
+			return next(ctx, d)
+		}
+	}
+}
+
+// Keyring holds signing keys by signer and verifies signatures with them.
+type Keyring struct {
+	mu   sync.RWMutex
+	keys map[string][]byte
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: map[string][]byte{}}
+}
+
+func (k *Keyring) Add(signer string, key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[signer] = key
+}
+
+func (k *Keyring) Key(signer string) ([]byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[signer]
+	return key, ok
+}
+
+func (k *Keyring) VerifySignature(ctx context.Context, signer string, content []byte, signature string) error {
+	key, ok := k.Key(signer)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownSigner, signer)
+	}
+	want := computeSignature(key, content)
+	if !hmac.Equal([]byte(want), []byte(signature)) {
+		return ErrBadSignature
+	}
+	return nil
+}
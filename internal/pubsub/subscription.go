@@ -0,0 +1,57 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrDeliveriesClosed = errors.New("pubsub: delivery channel closed")
+
+// Subscription is a running consumer started by one of the Subscribe
+// functions.
+type Subscription struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func newSubscription(cancel context.CancelFunc) *Subscription {
+	return &Subscription{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+// Close stops consuming and blocks until the handler has returned for
+// every delivery that was already handed to it.
+func (s *Subscription) Close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// Done is closed once the subscription has stopped, either because it was
+// closed, its context was cancelled or the broker closed the deliveries.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns nil while the subscription is running. Once Done is closed
+// it returns the context's error if the subscription was cancelled and
+// ErrDeliveriesClosed if the broker stopped delivering on its own.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Subscription) finish(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	s.cancel()
+	close(s.done)
+}
@@ -0,0 +1,106 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// Declarer is implemented by brokers that can declare exchanges, queues and
+// bindings. Declarations are idempotent as long as they match what already
+// exists in the broker.
+type Declarer interface {
+	QueueDeclarer
+	DeclareExchange(ctx context.Context, name, kind string, durable bool) error
+	BindQueue(ctx context.Context, queue, key, exchange string) error
+}
+
+// Verifier is implemented by brokers that can check an object exists with
+// the given properties without creating it. Checks return an error
+// wrapping one of the Err*NotFound errors for missing objects,
+// ErrPreconditionFailed for objects declared differently and
+// ErrUnverifiable when the broker can't tell.
+type Verifier interface {
+	CheckExchange(ctx context.Context, name, kind string, durable bool) error
+	CheckQueue(ctx context.Context, spec QueueSpec) error
+	CheckBinding(ctx context.Context, queue, key, exchange string) error
+}
+
+// Drift is one difference between a topology spec and the live broker.
+type Drift struct {
+	Object string
+	Err    error
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("%s: %v", d.Object, d.Err)
+}
+
+// Unverifiable reports whether the broker couldn't check the object, as
+// opposed to finding it missing or different.
+func (d Drift) Unverifiable() bool {
+	return errors.Is(d.Err, ErrUnverifiable)
+}
+
+// ApplyTopology declares every exchange, queue and binding in t.
+func ApplyTopology(ctx context.Context, d Declarer, t routing.Topology) error {
+	for _, e := range t.Exchanges {
+		err := d.DeclareExchange(ctx, e.Name, e.Kind, e.Durable)
+		if err != nil {
+			return fmt.Errorf("could not declare exchange %q: %w", e.Name, err)
+		}
+	}
+	for _, q := range t.Queues {
+		err := d.DeclareQueue(ctx, queueSpecFromRouting(q))
+		if err != nil {
+			return fmt.Errorf("could not declare queue %q: %w", q.Name, err)
+		}
+	}
+	for _, b := range t.Bindings {
+		err := d.BindQueue(ctx, b.Queue, b.Key, b.Exchange)
+		if err != nil {
+			return fmt.Errorf("could not bind queue %q to %q with %q: %w", b.Queue, b.Exchange, b.Key, err)
+		}
+	}
+	return nil
+}
+
+// VerifyTopology checks every object in t against the broker and returns
+// the ones that are missing, different or couldn't be checked.
+func VerifyTopology(ctx context.Context, v Verifier, t routing.Topology) []Drift {
+	drifts := []Drift{}
+	for _, e := range t.Exchanges {
+		err := v.CheckExchange(ctx, e.Name, e.Kind, e.Durable)
+		if err != nil {
+			drifts = append(drifts, Drift{Object: fmt.Sprintf("exchange %q", e.Name), Err: err})
+		}
+	}
+	for _, q := range t.Queues {
+		err := v.CheckQueue(ctx, queueSpecFromRouting(q))
+		if err != nil {
+			drifts = append(drifts, Drift{Object: fmt.Sprintf("queue %q", q.Name), Err: err})
+		}
+	}
+	for _, b := range t.Bindings {
+		err := v.CheckBinding(ctx, b.Queue, b.Key, b.Exchange)
+		if err != nil {
+			drifts = append(drifts, Drift{Object: fmt.Sprintf("binding %q -> %q (%q)", b.Exchange, b.Queue, b.Key), Err: err})
+		}
+	}
+	return drifts
+}
+
+func queueSpecFromRouting(q routing.QueueSpec) QueueSpec {
+	spec := QueueSpec{
+		Name:    q.Name,
+		Durable: q.Durable,
+	}
+	if q.DeadLetterExchange != "" {
+		spec.Args = Table{
+			"x-dead-letter-exchange": q.DeadLetterExchange,
+		}
+	}
+	return spec
+}
@@ -0,0 +1,181 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceParentHeader carries the W3C trace context of the span that
+// published a message, so the spans of the handlers it reaches join the
+// same trace.
+const TraceParentHeader = "traceparent"
+
+var ErrInvalidTraceParent = errors.New("pubsub: invalid traceparent")
+
+// SpanContext identifies a span and the trace it belongs to.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// TraceParent formats sc as a version 00 traceparent header value. Every
+// span is sampled.
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%x-%x-01", sc.TraceID, sc.SpanID)
+}
+
+// ParseTraceParent parses a traceparent header value. Versions after 00
+// are accepted as long as they start with the fields 00 defines.
+func ParseTraceParent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, ErrInvalidTraceParent
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.TraceID) {
+		return sc, ErrInvalidTraceParent
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.SpanID) {
+		return sc, ErrInvalidTraceParent
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return sc, ErrInvalidTraceParent
+	}
+	return sc, nil
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying sc. Messages published
+// with the returned context are part of sc's trace.
+func ContextWithSpan(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey{}, sc)
+}
+
+// SpanFromContext returns the span ctx carries. Handler contexts carry
+// the span of the delivery being handled.
+func SpanFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Span is a finished span as written by the exporter.
+type Span struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Kind       string            `json:"kind"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+var (
+	exporterMu sync.Mutex
+	exporter   *json.Encoder
+)
+
+// SetSpanExporter writes every span finished afterwards to w, one JSON
+// object per line. Spans are only propagated, not exported, until it is
+// called; pass nil to stop exporting.
+func SetSpanExporter(w io.Writer) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+	exporter = nil
+	if w != nil {
+		exporter = json.NewEncoder(w)
+	}
+}
+
+func exportSpan(s *Span) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+	if exporter == nil {
+		return
+	}
+	err := exporter.Encode(s)
+	if err != nil {
+		currentLogger().Error("could not export span", "error", err)
+	}
+}
+
+// startSpan starts a span that is a child of parent, or of the span in ctx
+// if parent is nil, or the root of a new trace if neither is set. The
+// returned context carries the new span.
+func startSpan(ctx context.Context, parent *SpanContext, name, kind string, attrs map[string]string) (context.Context, SpanContext, *Span) {
+	var sc SpanContext
+	s := &Span{Name: name, Kind: kind, Start: time.Now(), Attributes: attrs}
+	if p, ok := SpanFromContext(ctx); ok && parent == nil {
+		parent = &p
+	}
+	if parent != nil {
+		sc.TraceID = parent.TraceID
+		s.ParentID = hex.EncodeToString(parent.SpanID[:])
+	} else {
+		randomID(sc.TraceID[:])
+	}
+	randomID(sc.SpanID[:])
+	s.TraceID = hex.EncodeToString(sc.TraceID[:])
+	s.SpanID = hex.EncodeToString(sc.SpanID[:])
+	return ContextWithSpan(ctx, sc), sc, s
+}
+
+// startPublishSpan starts a producer span for msg and adds its traceparent
+// header. Retries and dead letters are republished with the trace they
+// were first published with, so a message that already has one gets no
+// span and the returned span is nil.
+func startPublishSpan(ctx context.Context, exchange, key string, msg *Publishing) (context.Context, *Span) {
+	if _, ok := msg.Headers[TraceParentHeader]; ok {
+		return ctx, nil
+	}
+	ctx, sc, span := startSpan(ctx, nil, "publish "+exchange, "producer", map[string]string{
+		"exchange":    exchange,
+		"routing_key": key,
+		"message_id":  msg.MessageID,
+	})
+	msg.Headers = cloneTable(msg.Headers)
+	msg.Headers[TraceParentHeader] = sc.TraceParent()
+	return ctx, span
+}
+
+func (s *Span) finish(err error) {
+	s.End = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	exportSpan(s)
+}
+
+func randomID(b []byte) {
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(fmt.Sprintf("pubsub: could not generate span ID: %v", err))
+	}
+}
+
+// traceParent returns the span context a delivery was published with.
+func traceParent(d Delivery) *SpanContext {
+	v, ok := d.Headers[TraceParentHeader].(string)
+	if !ok {
+		return nil
+	}
+	sc, err := ParseTraceParent(v)
+	if err != nil {
+		return nil
+	}
+	return &sc
+}
@@ -0,0 +1,52 @@
+package pubsub
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Validator is implemented by message types that can check themselves.
+// Subscribe calls Validate after decoding and rejects the delivery to the
+// dead-letter exchange if it returns an error.
+type Validator interface {
+	Validate() error
+}
+
+var (
+	validatorsMu sync.RWMutex
+	validators   = map[reflect.Type][]func(any) error{}
+)
+
+// RegisterValidator adds a check that Subscribe runs on every decoded T,
+// after T's own Validate method if it has one. Use it for types that can't
+// implement Validator themselves.
+func RegisterValidator[T any](fn func(T) error) {
+	validatorsMu.Lock()
+	defer validatorsMu.Unlock()
+	t := reflect.TypeFor[T]()
+	validators[t] = append(validators[t], func(v any) error {
+		return fn(v.(T))
+	})
+}
+
+func validate[T any](msg T) error {
+	if v, ok := any(msg).(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	} else if v, ok := any(&msg).(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	}
+
+	validatorsMu.RLock()
+	fns := validators[reflect.TypeFor[T]()]
+	validatorsMu.RUnlock()
+	for _, fn := range fns {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package pubsub
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// dispatch runs handle for every delivery on a pool of workers and returns
+// once deliveries is closed and every worker has finished. With orderedKeys
+// set, deliveries that share a routing key always go to the same worker so
+// they are handled in the order they arrived.
+func dispatch(deliveries <-chan Delivery, workers int, orderedKeys bool, handle func(Delivery)) {
+	if workers <= 1 {
+		for d := range deliveries {
+			handle(restoreRouting(d))
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	if !orderedKeys {
+		for i := 0; i < workers; i++ {
+			go func() {
+				defer wg.Done()
+				for d := range deliveries {
+					handle(restoreRouting(d))
+				}
+			}()
+		}
+		wg.Wait()
+		return
+	}
+
+	shards := make([]chan Delivery, workers)
+	for i := range shards {
+		shards[i] = make(chan Delivery)
+		go func(shard <-chan Delivery) {
+			defer wg.Done()
+			for d := range shard {
+				handle(d)
+			}
+		}(shards[i])
+	}
+	for d := range deliveries {
+		d = restoreRouting(d)
+		shards[shardFor(d.RoutingKey, workers)] <- d
+	}
+	for _, shard := range shards {
+		close(shard)
+	}
+	wg.Wait()
+}
+
+func shardFor(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
@@ -1,13 +1,64 @@
 package routing
 
-import "time"
+import (
+	"errors"
+	"time"
+)
 
 type PlayingState struct {
 	IsPaused bool
 }
 
+// PlayerRequest is the request body for RPCs that only need to know who is
+// asking.
+type PlayerRequest struct {
+	Username string
+}
+
+type OnlinePlayers struct {
+	Usernames []string
+}
+
+type SigningKey struct {
+	Key []byte
+}
+
+// WarKeyRequest asks for the key wars between two players are encrypted
+// with. The server only gives it to one of the two.
+type WarKeyRequest struct {
+	Attacker string
+	Defender string
+}
+
+type WarKey struct {
+	Key []byte
+}
+
+// SignatureCheck asks the server to verify a signature. Content is what
+// was signed, not the message body.
+type SignatureCheck struct {
+	Signer    string
+	Content   []byte
+	Signature string
+}
+
+type SignatureResult struct {
+	Valid  bool
+	Reason string
+}
+
 type GameLog struct {
 	CurrentTime time.Time
 	Message     string
 	Username    string
 }
+
+func (gl GameLog) Validate() error {
+	if gl.Username == "" {
+		return errors.New("game log has no username")
+	}
+	if gl.Message == "" {
+		return errors.New("game log has no message")
+	}
+	return nil
+}
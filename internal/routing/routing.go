@@ -8,6 +8,14 @@ const (
 	PauseKey = "pause"
 
 	GameLogSlug = "game_logs"
+
+	DeadLetterQueue = "peril_dlq"
+
+	PauseStateRPC      = "rpc.pause_state"
+	OnlinePlayersRPC   = "rpc.online_players"
+	SigningKeyRPC      = "rpc.signing_key"
+	VerifySignatureRPC = "rpc.verify_signature"
+	WarKeyRPC          = "rpc.war_key"
 )
 
 const (
@@ -0,0 +1,54 @@
+package routing
+
+const (
+	ExchangeKindDirect = "direct"
+	ExchangeKindTopic  = "topic"
+	ExchangeKindFanout = "fanout"
+)
+
+type ExchangeSpec struct {
+	Name    string
+	Kind    string
+	Durable bool
+}
+
+type QueueSpec struct {
+	Name               string
+	Durable            bool
+	DeadLetterExchange string
+}
+
+type BindingSpec struct {
+	Exchange string
+	Queue    string
+	Key      string
+}
+
+type Topology struct {
+	Exchanges []ExchangeSpec
+	Queues    []QueueSpec
+	Bindings  []BindingSpec
+}
+
+// PerilTopology is everything in the broker that outlives a single client:
+// the exchanges, the dead-letter queue and the shared durable queues.
+// Per-player queues are declared by the clients that consume them.
+var PerilTopology = Topology{
+	Exchanges: []ExchangeSpec{
+		{Name: ExchangePerilDirect, Kind: ExchangeKindDirect, Durable: true},
+		{Name: ExchangePerilTopic, Kind: ExchangeKindTopic, Durable: true},
+		{Name: ExchangePerilDLX, Kind: ExchangeKindFanout, Durable: true},
+	},
+	Queues: []QueueSpec{
+		// Discards from the dead-letter queue are dropped; dead-lettering
+		// them to peril_dlx would route them straight back.
+		{Name: DeadLetterQueue, Durable: true},
+		{Name: GameLogSlug, Durable: true, DeadLetterExchange: ExchangePerilDLX},
+		{Name: WarRecognitionsPrefix, Durable: true, DeadLetterExchange: ExchangePerilDLX},
+	},
+	Bindings: []BindingSpec{
+		{Exchange: ExchangePerilDLX, Queue: DeadLetterQueue, Key: "#"},
+		{Exchange: ExchangePerilTopic, Queue: GameLogSlug, Key: GameLogSlug + ".*"},
+		{Exchange: ExchangePerilTopic, Queue: WarRecognitionsPrefix, Key: WarRecognitionsPrefix + ".*"},
+	},
+}
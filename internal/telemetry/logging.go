@@ -0,0 +1,26 @@
+package telemetry
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// NewLogger returns a logger writing to stderr, so logs can be redirected
+// away from the game's output on stdout. format is text or json and level
+// is debug, info, warn or error.
+func NewLogger(format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q: must be text or json", format)
+}
@@ -0,0 +1,20 @@
+package telemetry
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+// ServeMetrics serves pubsub and game metrics on addr until the process
+// exits.
+func ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", pubsub.MetricsHandler())
+	slog.Info("serving metrics", "url", "http://"+addr+"/metrics")
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		slog.Error("could not serve metrics", "addr", addr, "error", err)
+	}
+}
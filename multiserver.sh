@@ -23,9 +23,10 @@ cleanup() {
 # Setup trap for SIGINT
 trap 'cleanup' SIGINT
 
-# Start the specified number of instances of the program in the background
+# Start the specified number of instances of the program in the background.
+# Each one remembers the game logs it handled in its own file.
 for (( i=0; i<num_instances; i++ )); do
-  go run ./cmd/server &
+  go run ./cmd/server -dedup-file "game_logs.$i.seen" &
   pids+=($!)
 done
 